@@ -3,8 +3,14 @@ module github.com/3lvia/edna-writer-go
 go 1.16
 
 require (
+	cloud.google.com/go v0.94.1
 	cloud.google.com/go/bigquery v1.24.0
-	github.com/3lvia/hn-config-lib-go v1.3.3 // indirect
+	github.com/3lvia/hn-config-lib-go v1.3.3
 	github.com/3lvia/metrics-go v0.0.2
-	github.com/pkg/errors v0.9.1 // indirect
+	github.com/prometheus/client_golang v1.11.0
+	go.opentelemetry.io/otel v1.3.0
+	go.opentelemetry.io/otel/metric v0.26.0
+	go.opentelemetry.io/otel/sdk v1.3.0
+	go.opentelemetry.io/otel/trace v1.3.0
+	google.golang.org/api v0.57.0
 )
@@ -0,0 +1,136 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const metricsAssertions = `sink_assertions`
+
+// QueryOperations is the query-capable extension of TableOperations, needed by streams with assertions and by the
+// iteration ledger. The table operations used by default implement it. Table operations set with WithTableOperations
+// must implement it for assertions to run and for the ledger to be consulted.
+type QueryOperations interface {
+	// Query runs the SQL as a query job in the given project, with the given named parameters, and returns the
+	// resulting rows.
+	Query(ctx context.Context, projectID, sql string, params ...bigquery.QueryParameter) ([]map[string]bigquery.Value, error)
+}
+
+// errQueriesUnsupported is returned when a stream has assertions but the table operations cannot run queries.
+var errQueriesUnsupported = errors.New("table operations do not implement QueryOperations")
+
+// Assertion is a data quality check run against the temporary table of a truncate stream before it replaces the
+// target table.
+type Assertion struct {
+	// Name identifies the assertion in errors and metrics.
+	Name string
+
+	// SQL is a query returning the rows that violate the assertion. The assertion passes if no rows are returned. The
+	// placeholder {table} is replaced with the quoted, fully qualified name of the temporary table.
+	SQL string
+}
+
+// AssertNotNull asserts that the column has no NULL values.
+func AssertNotNull(column string) Assertion {
+	return Assertion{
+		Name: "not_null_" + column,
+		SQL:  fmt.Sprintf("SELECT 1 FROM {table} WHERE `%s` IS NULL", column),
+	}
+}
+
+// AssertUnique asserts that no two rows have the same values in the given columns.
+func AssertUnique(columns ...string) Assertion {
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = "`" + c + "`"
+	}
+	keys := strings.Join(quoted, ", ")
+	return Assertion{
+		Name: "unique_" + strings.Join(columns, "_"),
+		SQL:  fmt.Sprintf("SELECT %s FROM {table} GROUP BY %s HAVING COUNT(*) > 1", keys, keys),
+	}
+}
+
+// AssertBetween asserts that the values of the column lie between the given SQL expressions, inclusive, such as
+// "TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 1 DAY)" and "CURRENT_TIMESTAMP()". NULL values are not checked.
+func AssertBetween(column, low, high string) Assertion {
+	return Assertion{
+		Name: "between_" + column,
+		SQL:  fmt.Sprintf("SELECT 1 FROM {table} WHERE `%s` NOT BETWEEN %s AND %s", column, low, high),
+	}
+}
+
+// WithAssertions makes a truncate stream run the given assertions against the temporary table of an iteration before
+// it replaces the target table. The target table is only replaced if all assertions pass. Otherwise, the temporary
+// table is kept for inspection and an *AssertionError is reported. Assertions are not run for streams using the
+// LoadJob write method, since these have no temporary table.
+func WithAssertions(assertions ...Assertion) StreamOption {
+	return func(collector *streamOptionsCollector) {
+		collector.assertions = append(collector.assertions, assertions...)
+	}
+}
+
+// AssertionResult is the outcome of a single assertion.
+type AssertionResult struct {
+	Name       string
+	Violations int64
+}
+
+// AssertionError is the error reported when one or more assertions fail.
+type AssertionError struct {
+	// Table is the temporary table that the assertions were run against.
+	Table string
+
+	// Failed holds the results of the assertions that failed.
+	Failed []AssertionResult
+}
+
+func (e *AssertionError) Error() string {
+	var failed []string
+	for _, r := range e.Failed {
+		failed = append(failed, fmt.Sprintf("%s (%d violations)", r.Name, r.Violations))
+	}
+	return fmt.Sprintf("assertions failed for %s: %s", e.Table, strings.Join(failed, ", "))
+}
+
+// assertionSQL returns the SQL counting the violations of the assertion in the table.
+func assertionSQL(a Assertion, table *bigquery.Table) string {
+	name := fmt.Sprintf("`%s.%s.%s`", table.ProjectID, table.DatasetID, table.TableID)
+	return fmt.Sprintf("SELECT COUNT(*) AS violations FROM (%s)", strings.ReplaceAll(a.SQL, "{table}", name))
+}
+
+// checkAssertions runs the assertions of the stream against the temporary table. An *AssertionError is returned if
+// any of them fail.
+func (s *streamHandler) checkAssertions(ctx context.Context, temp *bigquery.Table) error {
+	assertions := s.stream.opts.assertions
+	if len(assertions) == 0 {
+		return nil
+	}
+	q, ok := s.operations.(QueryOperations)
+	if !ok {
+		return errQueriesUnsupported
+	}
+
+	failed := &AssertionError{Table: temp.TableID}
+	for _, a := range assertions {
+		rows, err := q.Query(ctx, temp.ProjectID, assertionSQL(a, temp))
+		if err != nil {
+			return fmt.Errorf("while running assertion %s: %w", a.Name, err)
+		}
+		var violations int64
+		if len(rows) > 0 {
+			violations, _ = rows[0]["violations"].(int64)
+		}
+		s.observer.asserted(a.Name, violations == 0)
+		if violations > 0 {
+			failed.Failed = append(failed.Failed, AssertionResult{Name: a.Name, Violations: violations})
+		}
+	}
+	if len(failed.Failed) > 0 {
+		return failed
+	}
+	return nil
+}
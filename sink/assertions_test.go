@@ -0,0 +1,40 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"testing"
+)
+
+func Test_assertionSQL(t *testing.T) {
+	table := &bigquery.Table{ProjectID: "p", DatasetID: "d", TableID: "readings_temp"}
+
+	tests := []struct {
+		assertion Assertion
+		name      string
+		want      string
+	}{
+		{
+			AssertNotNull("meterId"),
+			"not_null_meterId",
+			"SELECT COUNT(*) AS violations FROM (SELECT 1 FROM `p.d.readings_temp` WHERE `meterId` IS NULL)",
+		},
+		{
+			AssertUnique("meterId", "ts"),
+			"unique_meterId_ts",
+			"SELECT COUNT(*) AS violations FROM (SELECT `meterId`, `ts` FROM `p.d.readings_temp` GROUP BY `meterId`, `ts` HAVING COUNT(*) > 1)",
+		},
+		{
+			AssertBetween("ts", "TIMESTAMP '2026-01-01'", "CURRENT_TIMESTAMP()"),
+			"between_ts",
+			"SELECT COUNT(*) AS violations FROM (SELECT 1 FROM `p.d.readings_temp` WHERE `ts` NOT BETWEEN TIMESTAMP '2026-01-01' AND CURRENT_TIMESTAMP())",
+		},
+	}
+	for _, tt := range tests {
+		if tt.assertion.Name != tt.name {
+			t.Errorf("unexpected name, got %s", tt.assertion.Name)
+		}
+		if got := assertionSQL(tt.assertion, table); got != tt.want {
+			t.Errorf("unexpected SQL, got %s", got)
+		}
+	}
+}
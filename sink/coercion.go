@@ -0,0 +1,520 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// jsonFieldType is the type of JSON columns, which the bigquery package does not declare.
+const jsonFieldType bigquery.FieldType = "JSON"
+
+// CoercionMode decides how values that do not fit their column exactly are treated.
+type CoercionMode int
+
+const (
+	// CoerceStrict converts values only when no information is lost, such as "42" to 42 for an INTEGER column, and
+	// parses strings only in the canonical formats of BigQuery and RFC 3339. Values that cannot be converted make the
+	// row fail with a *CoercionError. This is the default.
+	CoerceStrict CoercionMode = iota
+
+	// CoerceLenient also converts values that must be rounded or truncated to fit their column, such as 1.5 for an
+	// INTEGER column or 0.1234567891 for a NUMERIC column, and renders numbers, booleans and values implementing
+	// fmt.Stringer or holding JSON as strings. Values that cannot be converted are left unchanged.
+	CoerceLenient
+)
+
+// Converter converts the value of a column to the representation expected by BigQuery.
+type Converter func(v bigquery.Value) (bigquery.Value, error)
+
+// CoercionOptions configures the conversion of the values of rows received on a stream.
+type CoercionOptions struct {
+	// Mode decides how values that do not fit their column exactly are treated.
+	Mode CoercionMode
+
+	// Converters holds custom converters by the path of the column, such as "address.city". The value returned by a
+	// custom converter is used as is, and an error returned by it makes the row fail in either mode.
+	Converters map[string]Converter
+}
+
+// CoercionError is the error returned by Coerce, and reported for rows that could not be coerced.
+type CoercionError struct {
+	// Errors holds an error for each column that could not be coerced.
+	Errors []FieldError
+}
+
+func (e *CoercionError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.Error()
+	}
+	return "cannot coerce row: " + strings.Join(msgs, "; ")
+}
+
+// WKTer is implemented by geography values that can render themselves as well-known text, for GEOGRAPHY columns.
+type WKTer interface {
+	WKT() string
+}
+
+// WithCoercion makes the stream convert the values of every row to the representation expected by BigQuery for the
+// types of their columns when it is received, before the row is validated. Examples are strings, Unix epochs in
+// seconds and civil.DateTime values for TIMESTAMP columns, time.Time values for DATE, TIME and DATETIME columns,
+// float64 values and decimal strings for NUMERIC columns, maps and slices for JSON columns, and WKTer values for
+// GEOGRAPHY columns. time.Time values are read in UTC, and in strict mode only converted to DATE at midnight and never
+// to TIME, since the rest of the time would be lost. Rows that cannot be coerced are not written. A *CoercionError is reported for each of them, and
+// they are appended to the dead-letter table of the validation of the stream, if any.
+func WithCoercion(opts CoercionOptions) StreamOption {
+	return func(collector *streamOptionsCollector) {
+		collector.coercion = &opts
+	}
+}
+
+// Coerce returns a copy of the row with its values converted to the representation expected by BigQuery for the
+// types of their columns in the schema. Columns that are not in the schema are copied unchanged. In strict mode, a
+// *CoercionError listing the columns that could not be converted is returned.
+func Coerce(schema bigquery.Schema, row map[string]bigquery.Value, opts CoercionOptions) (map[string]bigquery.Value, error) {
+	c := &coercer{opts: opts}
+	out := c.record("", schema, row)
+	if len(c.errs) > 0 {
+		return nil, &CoercionError{Errors: c.errs}
+	}
+	return out, nil
+}
+
+type coercer struct {
+	opts CoercionOptions
+	errs []FieldError
+}
+
+func (c *coercer) record(prefix string, schema bigquery.Schema, row map[string]bigquery.Value) map[string]bigquery.Value {
+	out := make(map[string]bigquery.Value, len(row))
+	for k, v := range row {
+		out[k] = v
+	}
+	for _, f := range schema {
+		v, ok := row[f.Name]
+		if !ok {
+			continue
+		}
+		out[f.Name] = c.field(prefix+f.Name, f, v)
+	}
+	return out
+}
+
+func (c *coercer) field(path string, f *bigquery.FieldSchema, v bigquery.Value) bigquery.Value {
+	if conv, ok := c.opts.Converters[path]; ok {
+		out, err := conv(v)
+		if err != nil {
+			c.errs = append(c.errs, FieldError{Field: path, Reason: err.Error()})
+			return v
+		}
+		return out
+	}
+	v = unwrapNull(v)
+	if v == nil {
+		return nil
+	}
+	if !f.Repeated {
+		return c.value(path, f, v)
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice || rv.Type().Elem().Kind() == reflect.Uint8 {
+		// Left for validation to reject.
+		return v
+	}
+	out := make([]bigquery.Value, rv.Len())
+	for i := range out {
+		elem := unwrapNull(rv.Index(i).Interface())
+		if elem == nil {
+			out[i] = nil
+			continue
+		}
+		out[i] = c.value(fmt.Sprintf("%s[%d]", path, i), f, elem)
+	}
+	return out
+}
+
+// value converts a single non-null value to the type of the field. In strict mode, values that cannot be converted
+// are recorded as errors. In lenient mode, they are returned unchanged.
+func (c *coercer) value(path string, f *bigquery.FieldSchema, v bigquery.Value) bigquery.Value {
+	lenient := c.opts.Mode == CoerceLenient
+	var out bigquery.Value
+	var err error
+	switch f.Type {
+	case bigquery.StringFieldType:
+		out, err = toString(v, lenient)
+	case bigquery.BytesFieldType:
+		out, err = toBytes(v, lenient)
+	case bigquery.IntegerFieldType:
+		out, err = toInteger(v, lenient)
+	case bigquery.FloatFieldType:
+		out, err = toFloat(v, lenient)
+	case bigquery.BooleanFieldType:
+		out, err = toBool(v, lenient)
+	case bigquery.TimestampFieldType:
+		out, err = toTimestamp(v, lenient)
+	case bigquery.DateFieldType:
+		out, err = toDate(v, lenient)
+	case bigquery.TimeFieldType:
+		out, err = toTime(v, lenient)
+	case bigquery.DateTimeFieldType:
+		out, err = toDateTime(v, lenient)
+	case bigquery.NumericFieldType:
+		out, err = toNumeric(v, bigquery.NumericScaleDigits, lenient)
+	case bigquery.BigNumericFieldType:
+		out, err = toNumeric(v, bigquery.BigNumericScaleDigits, lenient)
+	case bigquery.GeographyFieldType:
+		out, err = toGeography(v, lenient)
+	case jsonFieldType:
+		out, err = toJSON(v)
+	case bigquery.RecordFieldType:
+		return c.nested(path, f, v)
+	default:
+		return v
+	}
+	if err == nil {
+		return out
+	}
+	if !lenient {
+		c.errs = append(c.errs, FieldError{Field: path, Reason: err.Error()})
+	}
+	return v
+}
+
+func (c *coercer) nested(path string, f *bigquery.FieldSchema, v bigquery.Value) bigquery.Value {
+	switch r := v.(type) {
+	case map[string]bigquery.Value:
+		return c.record(path+".", f.Schema, r)
+	case map[string]interface{}:
+		m := make(map[string]bigquery.Value, len(r))
+		for k, x := range r {
+			m[k] = x
+		}
+		return c.record(path+".", f.Schema, m)
+	}
+	return v
+}
+
+func cannot(v bigquery.Value, t bigquery.FieldType) error {
+	return fmt.Errorf("cannot convert %T %v to %s", v, v, t)
+}
+
+func toString(v bigquery.Value, lenient bool) (bigquery.Value, error) {
+	switch x := v.(type) {
+	case string:
+		return x, nil
+	case []byte:
+		if utf8.Valid(x) {
+			return string(x), nil
+		}
+	}
+	if !lenient {
+		return nil, cannot(v, bigquery.StringFieldType)
+	}
+	switch x := v.(type) {
+	case fmt.Stringer:
+		return x.String(), nil
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return fmt.Sprint(x), nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, cannot(v, bigquery.StringFieldType)
+	}
+	return string(b), nil
+}
+
+func toBytes(v bigquery.Value, lenient bool) (bigquery.Value, error) {
+	switch x := v.(type) {
+	case []byte:
+		return x, nil
+	case string:
+		if lenient {
+			return []byte(x), nil
+		}
+	}
+	return nil, cannot(v, bigquery.BytesFieldType)
+}
+
+func toInteger(v bigquery.Value, lenient bool) (bigquery.Value, error) {
+	switch x := v.(type) {
+	case int, int8, int16, int32, int64, uint8, uint16, uint32:
+		return x, nil
+	case uint:
+		if uint64(x) <= math.MaxInt64 {
+			return int64(x), nil
+		}
+	case uint64:
+		if x <= math.MaxInt64 {
+			return int64(x), nil
+		}
+	case string:
+		if i, err := strconv.ParseInt(strings.TrimSpace(x), 10, 64); err == nil {
+			return i, nil
+		}
+		if f, err := strconv.ParseFloat(strings.TrimSpace(x), 64); err == nil && lenient {
+			return toInteger(f, lenient)
+		}
+	case float32:
+		return toInteger(float64(x), lenient)
+	case float64:
+		// math.MaxInt64 is not representable as a float64 and rounds up to 2^63, which is out of range.
+		if x >= math.MinInt64 && x < math.MaxInt64 && (x == math.Trunc(x) || lenient) {
+			return int64(math.Round(x)), nil
+		}
+	case *big.Rat:
+		if x.IsInt() && x.Num().IsInt64() {
+			return x.Num().Int64(), nil
+		}
+		if lenient {
+			f, _ := x.Float64()
+			return toInteger(f, lenient)
+		}
+	case bool:
+		if lenient {
+			if x {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		}
+	}
+	return nil, cannot(v, bigquery.IntegerFieldType)
+}
+
+func toFloat(v bigquery.Value, lenient bool) (bigquery.Value, error) {
+	switch x := v.(type) {
+	case float64:
+		return x, nil
+	case float32:
+		return float64(x), nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return reflect.ValueOf(x).Convert(reflect.TypeOf(float64(0))).Float(), nil
+	case string:
+		if f, err := strconv.ParseFloat(strings.TrimSpace(x), 64); err == nil {
+			return f, nil
+		}
+	case *big.Rat:
+		f, exact := x.Float64()
+		if exact || lenient {
+			return f, nil
+		}
+	}
+	return nil, cannot(v, bigquery.FloatFieldType)
+}
+
+func toBool(v bigquery.Value, lenient bool) (bigquery.Value, error) {
+	switch x := v.(type) {
+	case bool:
+		return x, nil
+	case string:
+		if b, err := strconv.ParseBool(strings.TrimSpace(x)); err == nil {
+			return b, nil
+		}
+	case int, int8, int16, int32, int64, uint8, uint16, uint32:
+		if lenient {
+			return reflect.ValueOf(x).Convert(reflect.TypeOf(int64(0))).Int() != 0, nil
+		}
+	}
+	return nil, cannot(v, bigquery.BooleanFieldType)
+}
+
+// timestampLayouts are the layouts that strings are parsed with for TIMESTAMP columns. The first is used in strict
+// mode. Layouts without a zone are read as UTC.
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999 MST",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+func toTimestamp(v bigquery.Value, lenient bool) (bigquery.Value, error) {
+	switch x := v.(type) {
+	case time.Time:
+		return x, nil
+	case string:
+		s := strings.TrimSpace(x)
+		layouts := timestampLayouts[:1]
+		if lenient {
+			layouts = timestampLayouts
+		}
+		for _, layout := range layouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, nil
+			}
+		}
+		if lenient {
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return toTimestamp(f, lenient)
+			}
+		}
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		// Unix epoch in seconds.
+		secs, err := toInteger(x, false)
+		if err == nil {
+			return time.Unix(reflect.ValueOf(secs).Convert(reflect.TypeOf(int64(0))).Int(), 0).UTC(), nil
+		}
+	case float64:
+		if lenient || x == math.Trunc(x) {
+			sec, frac := math.Modf(x)
+			return time.Unix(int64(sec), int64(math.Round(frac*1e9))).UTC(), nil
+		}
+	case civil.DateTime:
+		if lenient {
+			return x.In(time.UTC), nil
+		}
+	}
+	return nil, cannot(v, bigquery.TimestampFieldType)
+}
+
+func toDate(v bigquery.Value, lenient bool) (bigquery.Value, error) {
+	switch x := v.(type) {
+	case civil.Date:
+		return x, nil
+	case time.Time:
+		// Times are read in UTC, and only midnight converts without loss.
+		d := civil.DateTimeOf(x.UTC())
+		if lenient || d.Time == (civil.Time{}) {
+			return d.Date, nil
+		}
+	case civil.DateTime:
+		if lenient || x.Time == (civil.Time{}) {
+			return x.Date, nil
+		}
+	case string:
+		if d, err := civil.ParseDate(strings.TrimSpace(x)); err == nil {
+			return d, nil
+		}
+		if lenient {
+			if t, err := toTimestamp(x, lenient); err == nil {
+				return civil.DateOf(t.(time.Time)), nil
+			}
+		}
+	}
+	return nil, cannot(v, bigquery.DateFieldType)
+}
+
+func toTime(v bigquery.Value, lenient bool) (bigquery.Value, error) {
+	switch x := v.(type) {
+	case civil.Time:
+		return x, nil
+	case time.Time:
+		if lenient {
+			return civil.TimeOf(x.UTC()), nil
+		}
+	case civil.DateTime:
+		if lenient {
+			return x.Time, nil
+		}
+	case string:
+		if t, err := civil.ParseTime(strings.TrimSpace(x)); err == nil {
+			return t, nil
+		}
+		if lenient {
+			if t, err := toTimestamp(x, lenient); err == nil {
+				return civil.TimeOf(t.(time.Time)), nil
+			}
+		}
+	}
+	return nil, cannot(v, bigquery.TimeFieldType)
+}
+
+func toDateTime(v bigquery.Value, lenient bool) (bigquery.Value, error) {
+	switch x := v.(type) {
+	case civil.DateTime:
+		return x, nil
+	case time.Time:
+		return civil.DateTimeOf(x.UTC()), nil
+	case civil.Date:
+		return civil.DateTime{Date: x}, nil
+	case string:
+		s := strings.TrimSpace(x)
+		if dt, err := civil.ParseDateTime(s); err == nil {
+			return dt, nil
+		}
+		if dt, err := civil.ParseDateTime(strings.Replace(s, " ", "T", 1)); err == nil {
+			return dt, nil
+		}
+		if lenient {
+			if t, err := toTimestamp(x, lenient); err == nil {
+				return civil.DateTimeOf(t.(time.Time)), nil
+			}
+		}
+	}
+	return nil, cannot(v, bigquery.DateTimeFieldType)
+}
+
+// toNumeric converts the value to a *big.Rat with at most the given number of digits after the decimal point. Floats
+// are read as their shortest decimal representation, so that 0.1 becomes 1/10 rather than the nearest binary fraction.
+func toNumeric(v bigquery.Value, scale int, lenient bool) (bigquery.Value, error) {
+	var r *big.Rat
+	switch x := v.(type) {
+	case *big.Rat:
+		r = x
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		r, _ = new(big.Rat).SetString(fmt.Sprint(x))
+	case float32:
+		r, _ = new(big.Rat).SetString(strconv.FormatFloat(float64(x), 'f', -1, 32))
+	case float64:
+		if !math.IsInf(x, 0) && !math.IsNaN(x) {
+			r, _ = new(big.Rat).SetString(strconv.FormatFloat(x, 'f', -1, 64))
+		}
+	case string:
+		r, _ = new(big.Rat).SetString(strings.TrimSpace(x))
+	}
+	if r == nil {
+		return nil, cannot(v, bigquery.NumericFieldType)
+	}
+
+	pow := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)
+	if new(big.Int).Mod(pow, r.Denom()).Sign() == 0 {
+		return r, nil
+	}
+	if !lenient {
+		return nil, fmt.Errorf("value %s has more than %d digits after the decimal point", r.FloatString(scale+1), scale)
+	}
+	rounded, _ := new(big.Rat).SetString(r.FloatString(scale))
+	return rounded, nil
+}
+
+func toGeography(v bigquery.Value, lenient bool) (bigquery.Value, error) {
+	switch x := v.(type) {
+	case string:
+		return x, nil
+	case WKTer:
+		return x.WKT(), nil
+	case []float64:
+		if lenient && len(x) == 2 {
+			return fmt.Sprintf("POINT(%s %s)", strconv.FormatFloat(x[0], 'f', -1, 64), strconv.FormatFloat(x[1], 'f', -1, 64)), nil
+		}
+	}
+	return nil, cannot(v, bigquery.GeographyFieldType)
+}
+
+func toJSON(v bigquery.Value) (bigquery.Value, error) {
+	switch x := v.(type) {
+	case string:
+		if json.Valid([]byte(x)) {
+			return x, nil
+		}
+		return nil, fmt.Errorf("string is not valid JSON")
+	case json.RawMessage:
+		return string(x), nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
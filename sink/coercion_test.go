@@ -0,0 +1,123 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"errors"
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type point struct{ lon, lat float64 }
+
+func (p point) WKT() string { return "POINT(1 2)" }
+
+func Test_Coerce(t *testing.T) {
+	at := time.Date(2021, 3, 4, 14, 5, 6, 0, time.UTC)
+	tests := []struct {
+		typ     bigquery.FieldType
+		in      bigquery.Value
+		mode    CoercionMode
+		want    bigquery.Value
+		invalid bool
+	}{
+		{bigquery.TimestampFieldType, "2021-03-04T14:05:06Z", CoerceStrict, at, false},
+		{bigquery.TimestampFieldType, "2021-03-04 14:05:06", CoerceStrict, nil, true},
+		{bigquery.TimestampFieldType, "2021-03-04 14:05:06", CoerceLenient, at, false},
+		{bigquery.TimestampFieldType, at.Unix(), CoerceStrict, at, false},
+		{bigquery.DateFieldType, at, CoerceStrict, nil, true},
+		{bigquery.DateFieldType, at, CoerceLenient, civil.Date{Year: 2021, Month: 3, Day: 4}, false},
+		{bigquery.DateFieldType, time.Date(2021, 3, 4, 1, 0, 0, 0, time.FixedZone("CET", 3600)), CoerceStrict, civil.Date{Year: 2021, Month: 3, Day: 4}, false},
+		{bigquery.DateFieldType, time.Date(2021, 3, 4, 0, 0, 0, 0, time.FixedZone("CET", 3600)), CoerceStrict, nil, true},
+		{bigquery.TimeFieldType, at, CoerceStrict, nil, true},
+		{bigquery.TimeFieldType, at.In(time.FixedZone("CET", 3600)), CoerceLenient, civil.Time{Hour: 14, Minute: 5, Second: 6}, false},
+		{bigquery.DateTimeFieldType, at.In(time.FixedZone("CET", 3600)), CoerceStrict, civil.DateTimeOf(at), false},
+		{bigquery.DateTimeFieldType, "2021-03-04 14:05:06", CoerceStrict, civil.DateTimeOf(at), false},
+		{bigquery.NumericFieldType, 0.1, CoerceStrict, big.NewRat(1, 10), false},
+		{bigquery.NumericFieldType, "12.345", CoerceStrict, big.NewRat(12345, 1000), false},
+		{bigquery.NumericFieldType, 0.1234567891, CoerceStrict, nil, true},
+		{bigquery.NumericFieldType, 0.1234567891, CoerceLenient, big.NewRat(123456789, 1000000000), false},
+		{bigquery.IntegerFieldType, "42", CoerceStrict, int64(42), false},
+		{bigquery.IntegerFieldType, 1.5, CoerceStrict, nil, true},
+		{bigquery.IntegerFieldType, 1.5, CoerceLenient, int64(2), false},
+		{bigquery.IntegerFieldType, float64(math.MaxInt64), CoerceStrict, nil, true},
+		{bigquery.IntegerFieldType, float64(math.MinInt64), CoerceStrict, int64(math.MinInt64), false},
+		{bigquery.IntegerFieldType, "x", CoerceLenient, "x", false},
+		{bigquery.StringFieldType, 42, CoerceStrict, nil, true},
+		{bigquery.StringFieldType, 42, CoerceLenient, "42", false},
+		{bigquery.BooleanFieldType, "true", CoerceStrict, true, false},
+		{bigquery.GeographyFieldType, point{}, CoerceStrict, "POINT(1 2)", false},
+		{bigquery.GeographyFieldType, []float64{10.5, 59.9}, CoerceLenient, "POINT(10.5 59.9)", false},
+		{jsonFieldType, map[string]interface{}{"a": 1}, CoerceStrict, `{"a":1}`, false},
+		{jsonFieldType, "{", CoerceStrict, nil, true},
+	}
+	for _, tt := range tests {
+		schema := bigquery.Schema{{Name: "v", Type: tt.typ}}
+		out, err := Coerce(schema, map[string]bigquery.Value{"v": tt.in}, CoercionOptions{Mode: tt.mode})
+		if tt.invalid {
+			var cerr *CoercionError
+			if !errors.As(err, &cerr) || len(cerr.Errors) != 1 || cerr.Errors[0].Field != "v" {
+				t.Errorf("%s %T %v: expected a coercion error for v, got %v", tt.typ, tt.in, tt.in, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %T %v: unexpected error %v", tt.typ, tt.in, tt.in, err)
+			continue
+		}
+		got := out["v"]
+		if r, ok := got.(*big.Rat); ok {
+			if r.Cmp(tt.want.(*big.Rat)) != 0 {
+				t.Errorf("%s %v: expected %v, got %v", tt.typ, tt.in, tt.want, r)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %T %v: expected %T %v, got %T %v", tt.typ, tt.in, tt.in, tt.want, tt.want, got, got)
+		}
+	}
+}
+
+func Test_Coerce_Nested(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "ids", Type: bigquery.IntegerFieldType, Repeated: true},
+		{Name: "address", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "city", Type: bigquery.StringFieldType},
+			{Name: "since", Type: bigquery.DateFieldType},
+		}},
+	}
+	opts := CoercionOptions{Converters: map[string]Converter{
+		"address.city": func(v bigquery.Value) (bigquery.Value, error) {
+			return "Oslo", nil
+		},
+	}}
+	row := map[string]bigquery.Value{
+		"ids":     []string{"1", "2"},
+		"address": map[string]interface{}{"city": 47, "since": "2020-01-02"},
+		"extra":   "kept",
+	}
+	out, err := Coerce(schema, row, opts)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	want := map[string]bigquery.Value{
+		"ids":     []bigquery.Value{int64(1), int64(2)},
+		"address": map[string]bigquery.Value{"city": "Oslo", "since": civil.Date{Year: 2020, Month: 1, Day: 2}},
+		"extra":   "kept",
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("expected %v, got %v", want, out)
+	}
+	if err := Validate(schema, out); err == nil || len(err.(*ValidationError).Errors) != 1 {
+		t.Errorf("expected only the unknown column to fail validation, got %v", err)
+	}
+
+	_, err = Coerce(schema, map[string]bigquery.Value{"ids": []interface{}{1, "x"}}, CoercionOptions{})
+	cerr, ok := err.(*CoercionError)
+	if !ok || len(cerr.Errors) != 1 || cerr.Errors[0].Field != "ids[1]" {
+		t.Errorf("expected a coercion error for ids[1], got %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"strings"
+	"time"
+)
+
+// DatasetOperations provides an abstraction for the concrete operations that happen against BigQuery datasets.
+type DatasetOperations interface {
+	// EnsureDataset verifies that the dataset exists in the given project. If the dataset does not exist and create is
+	// not nil, the dataset is created with the given options, otherwise an error is returned. Existing datasets are
+	// left untouched.
+	EnsureDataset(ctx context.Context, projectID, datasetID string, create *DatasetOptions) error
+}
+
+// DatasetOptions holds the settings used when this package creates a dataset that does not already exist.
+type DatasetOptions struct {
+	// Location is the geographic location of the dataset, for instance EU.
+	Location string
+
+	// DefaultTableExpiration is the default lifetime of new tables in the dataset. Zero means that tables never expire.
+	DefaultTableExpiration time.Duration
+
+	// Labels are set on the dataset.
+	Labels map[string]string
+
+	// Access is the list of access entries of the dataset. If empty, BigQuery applies its default access.
+	Access []*bigquery.AccessEntry
+
+	// KMSKeyName is the Cloud KMS key used as the default encryption key for new tables in the dataset.
+	KMSKeyName string
+}
+
+func (o *tableOperations) EnsureDataset(ctx context.Context, projectID, datasetID string, create *DatasetOptions) error {
+	ds := o.client(projectID).Dataset(datasetID)
+	_, err := ds.Metadata(ctx)
+	if err == nil {
+		return nil
+	}
+	if !strings.Contains(err.Error(), "googleapi: Error 404: Not found:") || create == nil {
+		return err
+	}
+	if err := ds.Create(ctx, datasetMetadata(create)); err != nil {
+		if !strings.Contains(err.Error(), "googleapi: Error 409: Already Exists:") {
+			return err
+		}
+	}
+	return nil
+}
+
+func datasetMetadata(opts *DatasetOptions) *bigquery.DatasetMetadata {
+	md := &bigquery.DatasetMetadata{
+		Location:               opts.Location,
+		DefaultTableExpiration: opts.DefaultTableExpiration,
+		Labels:                 opts.Labels,
+		Access:                 opts.Access,
+	}
+	if opts.KMSKeyName != "" {
+		md.DefaultEncryptionConfig = &bigquery.EncryptionConfig{KMSKeyName: opts.KMSKeyName}
+	}
+	return md
+}
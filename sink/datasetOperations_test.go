@@ -0,0 +1,66 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type fakeDatasetOperations struct {
+	datasets map[string]*DatasetOptions
+}
+
+func (f *fakeDatasetOperations) EnsureDataset(ctx context.Context, projectID, datasetID string, create *DatasetOptions) error {
+	key := fmt.Sprintf("%s.%s", projectID, datasetID)
+	if _, ok := f.datasets[key]; ok {
+		return nil
+	}
+	if create == nil {
+		return fmt.Errorf("dataset %s not found", key)
+	}
+	f.datasets[key] = create
+	return nil
+}
+
+func Test_ensureDatasets(t *testing.T) {
+	ctx := context.Background()
+	streams := []*streamImpl{
+		{schema: Schema{ProjectID: "p1", DatasetID: "raw"}},
+		{schema: Schema{ProjectID: "p1", DatasetID: "raw"}},
+		{schema: Schema{ProjectID: "p2", DatasetID: "curated"}},
+	}
+
+	ops := &fakeDatasetOperations{datasets: map[string]*DatasetOptions{"p1.raw": {}}}
+	err := ensureDatasets(ctx, ops, streams, nil)
+	if err == nil {
+		t.Fatal("expected error for missing dataset")
+	}
+
+	create := &DatasetOptions{Location: "EU", DefaultTableExpiration: time.Hour, Labels: map[string]string{"team": "edna"}}
+	err = ensureDatasets(ctx, ops, streams, create)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(ops.datasets) != 2 {
+		t.Errorf("unexpected number of datasets, got %d", len(ops.datasets))
+	}
+	if got := ops.datasets["p2.curated"]; got != create {
+		t.Errorf("dataset created with unexpected options, got %v", got)
+	}
+}
+
+func Test_datasetMetadata(t *testing.T) {
+	md := datasetMetadata(&DatasetOptions{Location: "EU", KMSKeyName: "projects/p/locations/eu/keyRings/r/cryptoKeys/k"})
+	if md.Location != "EU" {
+		t.Errorf("unexpected location, got %s", md.Location)
+	}
+	if md.DefaultEncryptionConfig == nil || md.DefaultEncryptionConfig.KMSKeyName != "projects/p/locations/eu/keyRings/r/cryptoKeys/k" {
+		t.Errorf("unexpected encryption config, got %v", md.DefaultEncryptionConfig)
+	}
+
+	md = datasetMetadata(&DatasetOptions{})
+	if md.DefaultEncryptionConfig != nil {
+		t.Errorf("expected no encryption config, got %v", md.DefaultEncryptionConfig)
+	}
+}
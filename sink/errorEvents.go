@@ -0,0 +1,132 @@
+package sink
+
+import (
+	"sync"
+)
+
+const metricsErrorsDropped = `sink_errors_dropped`
+
+// ErrorEvent describes an error that occurred in the handler of a stream. Events are delivered to the callback set
+// with WithErrorHandler and to the channel set with WithErrorChannel, where they are received as errors that can be
+// inspected with errors.As.
+type ErrorEvent struct {
+	// Stream is the type of the stream.
+	Stream string
+
+	// IterationID is the ID of the iteration during which the error occurred, if any.
+	IterationID string
+
+	// Step names the part of the handler that failed, such as "writing_to_temporary_table".
+	Step string
+
+	// Table is the destination table being written to when the error occurred, if any.
+	Table string
+
+	// Rows is the number of rows affected by the error, such as the rows that could not be written in a flush.
+	Rows int
+
+	// Retryable is true if the error is likely to be transient, such as rate limiting, timeouts and server errors.
+	Retryable bool
+
+	// Err is the underlying error.
+	Err error
+
+	msg string
+}
+
+// Error returns the context of the error, such as "while writing to temporary table", followed by the underlying error.
+func (e *ErrorEvent) Error() string {
+	return e.msg + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *ErrorEvent) Unwrap() error {
+	return e.Err
+}
+
+// retryable returns true for the error classes that are likely to be transient.
+func retryable(class string) bool {
+	switch class {
+	case "timeout", "rate_limit", "server":
+		return true
+	}
+	return false
+}
+
+// ErrorDropPolicy decides which error events are dropped when the error queue is full.
+type ErrorDropPolicy int
+
+const (
+	// DropNewest drops events that arrive while the queue is full. This is the default.
+	DropNewest ErrorDropPolicy = iota
+
+	// DropOldest drops the oldest event in the queue to make room for the new one.
+	DropOldest
+)
+
+// ErrorQueueOptions configures the queue that error events wait in until they are delivered.
+type ErrorQueueOptions struct {
+	// Size is the number of events the queue holds. Defaults to 100.
+	Size int
+
+	// Policy decides which events are dropped when the queue is full.
+	Policy ErrorDropPolicy
+}
+
+const defaultErrorQueueSize = 100
+
+// errorQueue is a bounded queue of error events. Publishing never blocks, so that stream handlers are not stalled by
+// slow or absent consumers of the events. Dropped events are counted in the metric sink_errors_dropped.
+type errorQueue struct {
+	opts    ErrorQueueOptions
+	metrics Metrics
+	mux     *sync.Mutex
+	events  []*ErrorEvent
+	signal  chan struct{}
+}
+
+func newErrorQueue(opts ErrorQueueOptions, m Metrics) *errorQueue {
+	if opts.Size <= 0 {
+		opts.Size = defaultErrorQueueSize
+	}
+	return &errorQueue{opts: opts, metrics: m, mux: &sync.Mutex{}, signal: make(chan struct{}, 1)}
+}
+
+// publish adds the event to the queue, dropping an event according to the policy if the queue is full.
+func (q *errorQueue) publish(e *ErrorEvent) {
+	q.mux.Lock()
+	if len(q.events) >= q.opts.Size {
+		dropped := e
+		if q.opts.Policy == DropOldest {
+			dropped = q.events[0]
+			q.events = append(q.events[1:], e)
+		}
+		q.mux.Unlock()
+		q.metrics.AddCounter(metricsErrorsDropped, map[string]string{"stream": dropped.Stream}, 1)
+		return
+	}
+	q.events = append(q.events, e)
+	q.mux.Unlock()
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch delivers the queued events in order, forever.
+func (q *errorQueue) dispatch(deliver func(e *ErrorEvent)) {
+	for range q.signal {
+		for {
+			q.mux.Lock()
+			if len(q.events) == 0 {
+				q.mux.Unlock()
+				break
+			}
+			e := q.events[0]
+			q.events = q.events[1:]
+			q.mux.Unlock()
+			deliver(e)
+		}
+	}
+}
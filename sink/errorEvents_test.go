@@ -0,0 +1,54 @@
+package sink
+
+import (
+	"errors"
+	"testing"
+)
+
+type countingMetrics struct {
+	nopMetrics
+	counters map[string]float64
+}
+
+func (c *countingMetrics) AddCounter(name string, labels map[string]string, v float64) {
+	c.counters[labelKey(name, labels)] += v
+}
+
+func Test_errorQueue(t *testing.T) {
+	tests := []struct {
+		policy ErrorDropPolicy
+		want   []string
+	}{
+		{DropNewest, []string{"a", "b"}},
+		{DropOldest, []string{"b", "c"}},
+	}
+	for _, tt := range tests {
+		m := &countingMetrics{counters: map[string]float64{}}
+		q := newErrorQueue(ErrorQueueOptions{Size: 2, Policy: tt.policy}, m)
+		for _, step := range []string{"a", "b", "c"} {
+			q.publish(&ErrorEvent{Stream: "readings", Step: step, Err: errors.New("boom")})
+		}
+
+		var got []string
+		for _, e := range q.events {
+			got = append(got, e.Step)
+		}
+		if len(got) != len(tt.want) || got[0] != tt.want[0] || got[1] != tt.want[1] {
+			t.Errorf("policy %d: unexpected events in queue, got %v", tt.policy, got)
+		}
+		if n := m.counters[labelKey(metricsErrorsDropped, map[string]string{"stream": "readings"})]; n != 1 {
+			t.Errorf("policy %d: unexpected number of dropped events, got %f", tt.policy, n)
+		}
+	}
+}
+
+func TestErrorEvent_Error(t *testing.T) {
+	cause := errors.New("boom")
+	e := &ErrorEvent{Err: cause, msg: "while writing to temporary table"}
+	if e.Error() != "while writing to temporary table: boom" {
+		t.Errorf("unexpected message, got %s", e.Error())
+	}
+	if !errors.Is(e, cause) {
+		t.Error("expected the event to wrap the underlying error")
+	}
+}
@@ -0,0 +1,136 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"fmt"
+)
+
+const metricsGuardTrips = `sink_guard_trips`
+
+const (
+	// GuardMinRows is the guard that trips when an iteration has fewer rows than TruncateGuard.MinRows.
+	GuardMinRows = "min_rows"
+
+	// GuardMaxShrink is the guard that trips when an iteration would shrink the target table by more than
+	// TruncateGuard.MaxShrinkRatio.
+	GuardMaxShrink = "max_shrink"
+
+	// GuardPredicate is the guard that trips when TruncateGuard.Check returns an error.
+	GuardPredicate = "predicate"
+)
+
+// TruncateGuard protects the target table of a truncate stream from being replaced by an empty or shrunken iteration.
+// The guards are evaluated when an iteration completes, before the target table is replaced. Zero values disable the
+// respective guard.
+type TruncateGuard struct {
+	// MinRows is the minimum number of rows an iteration must have.
+	MinRows int
+
+	// MaxShrinkRatio is the largest allowed reduction in the number of rows compared to the target table, as a
+	// fraction of the rows in the target table. With 0.5, an iteration must have at least half the rows of the
+	// target table. Target tables without rows are never considered shrunk.
+	MaxShrinkRatio float64
+
+	// Check is called with the outcome of the iteration if the other guards pass. Returning an error trips the guard.
+	Check func(ctx context.Context, info GuardInfo) error
+}
+
+// GuardInfo describes an iteration that is about to replace the target table.
+type GuardInfo struct {
+	// Stream is the type of the stream.
+	Stream string
+
+	// Table is the target table.
+	Table *bigquery.Table
+
+	// TempTable is the temporary table holding the rows of the iteration. It is nil for streams using the LoadJob
+	// write method.
+	TempTable *bigquery.Table
+
+	// Rows is the number of rows in the iteration.
+	Rows int
+
+	// TargetRows is the number of rows currently in the target table. For streams with view swaps, it is the number of
+	// rows in the table version the view currently selects from.
+	TargetRows int64
+}
+
+// GuardError is the error reported when a truncate guard trips. The target table is left unchanged, and the temporary
+// table holding the rows of the iteration, if any, is kept for inspection. Table versions of streams with view swaps
+// are kept until ViewSwapOptions.RejectedRetention has passed.
+type GuardError struct {
+	// Guard is the guard that tripped, one of GuardMinRows, GuardMaxShrink and GuardPredicate.
+	Guard string
+
+	// Info describes the iteration that was rejected.
+	Info GuardInfo
+
+	// Err is the error returned by TruncateGuard.Check, if that was the guard that tripped.
+	Err error
+}
+
+func (e *GuardError) Error() string {
+	table := e.Info.Table.TableID
+	switch e.Guard {
+	case GuardMinRows:
+		return fmt.Sprintf("truncate guard %s tripped for %s: iteration has %d rows", e.Guard, table, e.Info.Rows)
+	case GuardMaxShrink:
+		return fmt.Sprintf("truncate guard %s tripped for %s: iteration has %d rows, target has %d", e.Guard, table, e.Info.Rows, e.Info.TargetRows)
+	}
+	return fmt.Sprintf("truncate guard %s tripped for %s: %v", e.Guard, table, e.Err)
+}
+
+func (e *GuardError) Unwrap() error {
+	return e.Err
+}
+
+// WithTruncateGuard makes a truncate stream evaluate the given guard before replacing the target table with the rows
+// of an iteration. If the guard trips, the target table is left unchanged and a *GuardError is reported.
+func WithTruncateGuard(g TruncateGuard) StreamOption {
+	return func(collector *streamOptionsCollector) {
+		collector.guard = &g
+	}
+}
+
+// checkGuard evaluates the truncate guard of the stream, if any, against an iteration of the given number of rows
+// that is about to replace the target table. The target rows are counted in current, which is the target table
+// itself unless the target is a view. If current is nil, the target has no rows.
+func (s *streamHandler) checkGuard(ctx context.Context, table, current, temp *bigquery.Table, rows int) error {
+	g := s.stream.opts.guard
+	if g == nil {
+		return nil
+	}
+	info := GuardInfo{Stream: s.stream.Type(), Table: table, TempTable: temp, Rows: rows}
+
+	if g.MinRows > 0 && rows < g.MinRows {
+		return s.tripped(&GuardError{Guard: GuardMinRows, Info: info})
+	}
+
+	if current != nil && (g.MaxShrinkRatio > 0 || g.Check != nil) {
+		md, err := s.metadata(ctx, current)
+		if err != nil {
+			return err
+		}
+		info.TargetRows = int64(md.NumRows)
+	}
+
+	if g.MaxShrinkRatio > 0 && info.TargetRows > 0 {
+		shrink := float64(info.TargetRows-int64(rows)) / float64(info.TargetRows)
+		if shrink > g.MaxShrinkRatio {
+			return s.tripped(&GuardError{Guard: GuardMaxShrink, Info: info})
+		}
+	}
+
+	if g.Check != nil {
+		if err := g.Check(ctx, info); err != nil {
+			return s.tripped(&GuardError{Guard: GuardPredicate, Info: info, Err: err})
+		}
+	}
+	return nil
+}
+
+func (s *streamHandler) tripped(e *GuardError) error {
+	s.observer.guardTripped(e.Guard)
+	return e
+}
@@ -0,0 +1,197 @@
+package sink
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// StepIdle is the step of a stream that is waiting for rows or signals from the producer.
+	StepIdle = "idle"
+
+	// StepFlushing is the step of a stream that is writing buffered rows during a flush.
+	StepFlushing = "flushing"
+
+	// StepCompleting is the step of a stream that is writing buffered rows when completing an iteration.
+	StepCompleting = "completing"
+)
+
+// StreamHealth is the health of a single stream as reported by Health.
+type StreamHealth struct {
+	// Stream is the type of the stream.
+	Stream string `json:"stream"`
+
+	// Started is true once the stream's handler has been started.
+	Started bool `json:"started"`
+
+	// StartedAt is when the stream's handler was started.
+	StartedAt time.Time `json:"startedAt"`
+
+	// LastFlush is when the last flush or completion without errors ended. It is zero until the first one.
+	LastFlush time.Time `json:"lastFlush"`
+
+	// LastFailure is when the last flush or completion with errors ended.
+	LastFailure time.Time `json:"lastFailure"`
+
+	// ConsecutiveFailures is the number of flushes and completions with errors since the last one without.
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+
+	// BufferedRows is the number of rows received but not yet written.
+	BufferedRows int `json:"bufferedRows"`
+
+	// Step is what the handler of the stream is currently doing. It is StepIdle, StepFlushing, StepCompleting or the
+	// name of the operation against BigQuery in progress, such as "copy_table".
+	Step string `json:"step"`
+
+	// StepSince is when the current step was entered.
+	StepSince time.Time `json:"stepSince"`
+}
+
+// HealthThresholds decides when a stream is considered unhealthy. Zero values disable the respective check.
+type HealthThresholds struct {
+	// MaxStepDuration is the longest a stream may stay in a step other than StepIdle before it is considered stuck.
+	// Exceeding it fails both liveness and readiness.
+	MaxStepDuration time.Duration
+
+	// MaxConsecutiveFailures is the number of consecutive failed flushes at which readiness fails.
+	MaxConsecutiveFailures int
+
+	// MaxFlushAge is the longest time since the last successful flush, or since the start if there is none, before
+	// readiness fails.
+	MaxFlushAge time.Duration
+}
+
+// Live returns true unless the stream is stuck in a step.
+func (h StreamHealth) Live(t HealthThresholds, now time.Time) bool {
+	if t.MaxStepDuration > 0 && h.Step != StepIdle && now.Sub(h.StepSince) > t.MaxStepDuration {
+		return false
+	}
+	return true
+}
+
+// Ready returns true if the stream has been started, is live and is writing successfully.
+func (h StreamHealth) Ready(t HealthThresholds, now time.Time) bool {
+	if !h.Started || !h.Live(t, now) {
+		return false
+	}
+	if t.MaxConsecutiveFailures > 0 && h.ConsecutiveFailures >= t.MaxConsecutiveFailures {
+		return false
+	}
+	if t.MaxFlushAge > 0 {
+		last := h.LastFlush
+		if last.IsZero() {
+			last = h.StartedAt
+		}
+		if now.Sub(last) > t.MaxFlushAge {
+			return false
+		}
+	}
+	return true
+}
+
+// Health returns the health of every registered stream.
+func Health() []StreamHealth {
+	var health []StreamHealth
+	for _, stream := range streams {
+		health = append(health, stream.health.snapshot())
+	}
+	return health
+}
+
+// LivenessHandler returns an http.Handler that reports the health of every stream as JSON. It responds with status
+// 503 if any stream is stuck according to the thresholds, and 200 otherwise.
+func LivenessHandler(t HealthThresholds) http.Handler {
+	return &healthHandler{thresholds: t, check: StreamHealth.Live}
+}
+
+// ReadinessHandler returns an http.Handler that reports the health of every stream as JSON. It responds with status
+// 503 unless every stream is ready according to the thresholds, and 200 otherwise.
+func ReadinessHandler(t HealthThresholds) http.Handler {
+	return &healthHandler{thresholds: t, check: StreamHealth.Ready}
+}
+
+type healthHandler struct {
+	thresholds HealthThresholds
+	check      func(h StreamHealth, t HealthThresholds, now time.Time) bool
+}
+
+type healthReport struct {
+	Healthy bool           `json:"healthy"`
+	Streams []StreamHealth `json:"streams"`
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	report := healthReport{Healthy: true, Streams: Health()}
+	for _, s := range report.Streams {
+		if !h.check(s, h.thresholds, now) {
+			report.Healthy = false
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// healthState holds the health of a stream as updated by its handler.
+type healthState struct {
+	mux    *sync.Mutex
+	health StreamHealth
+}
+
+func newHealthState(stream string) *healthState {
+	return &healthState{mux: &sync.Mutex{}, health: StreamHealth{Stream: stream, Step: StepIdle}}
+}
+
+func (h *healthState) snapshot() StreamHealth {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.health
+}
+
+func (h *healthState) started() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.health.Started = true
+	h.health.StartedAt = time.Now()
+	h.health.StepSince = h.health.StartedAt
+}
+
+func (h *healthState) buffered(rows int) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.health.BufferedRows = rows
+}
+
+// enter sets the current step, returning a function that restores the previous one.
+func (h *healthState) enter(step string) func() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	previous := h.health.Step
+	h.health.Step = step
+	h.health.StepSince = time.Now()
+	return func() {
+		h.mux.Lock()
+		defer h.mux.Unlock()
+		h.health.Step = previous
+		h.health.StepSince = time.Now()
+	}
+}
+
+// flushed records the outcome of a flush or completion.
+func (h *healthState) flushed(ok bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if ok {
+		h.health.LastFlush = time.Now()
+		h.health.ConsecutiveFailures = 0
+		return
+	}
+	h.health.LastFailure = time.Now()
+	h.health.ConsecutiveFailures++
+}
@@ -0,0 +1,47 @@
+package sink
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreamHealth_Ready(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	thresholds := HealthThresholds{
+		MaxStepDuration:        time.Minute,
+		MaxConsecutiveFailures: 3,
+		MaxFlushAge:            time.Hour,
+	}
+	healthy := StreamHealth{
+		Started:   true,
+		StartedAt: now.Add(-2 * time.Hour),
+		LastFlush: now.Add(-time.Minute),
+		Step:      StepIdle,
+		StepSince: now.Add(-time.Minute),
+	}
+
+	tests := []struct {
+		name  string
+		apply func(h *StreamHealth)
+		live  bool
+		ready bool
+	}{
+		{"healthy", func(h *StreamHealth) {}, true, true},
+		{"not started", func(h *StreamHealth) { h.Started = false }, true, false},
+		{"idle for long", func(h *StreamHealth) { h.StepSince = now.Add(-time.Hour) }, true, true},
+		{"stuck in copy", func(h *StreamHealth) { h.Step = "copy_table"; h.StepSince = now.Add(-2 * time.Minute) }, false, false},
+		{"failing", func(h *StreamHealth) { h.ConsecutiveFailures = 3 }, true, false},
+		{"stale", func(h *StreamHealth) { h.LastFlush = now.Add(-2 * time.Hour) }, true, false},
+		{"never flushed", func(h *StreamHealth) { h.LastFlush = time.Time{} }, true, false},
+	}
+	for _, tt := range tests {
+		h := healthy
+		tt.apply(&h)
+		if got := h.Live(thresholds, now); got != tt.live {
+			t.Errorf("%s: expected live %v, got %v", tt.name, tt.live, got)
+		}
+		if got := h.Ready(thresholds, now); got != tt.ready {
+			t.Errorf("%s: expected ready %v, got %v", tt.name, tt.ready, got)
+		}
+	}
+}
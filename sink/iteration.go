@@ -0,0 +1,308 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrIterationClosed is returned when an iteration is used after it was committed or aborted.
+var ErrIterationClosed = errors.New("iteration has been committed or aborted")
+
+// ErrNoProducers is returned by Done when no producer is registered with the iteration.
+var ErrNoProducers = errors.New("no producers are registered with the iteration")
+
+// ErrIterationOpen is returned by Begin when the stream already has an iteration that is neither committed nor
+// aborted.
+var ErrIterationOpen = errors.New("stream already has an open iteration")
+
+// IterativeStream is the extension of SourceStream for producers that begin, commit and abort their iterations
+// explicitly. The streams returned by Stream implement it.
+type IterativeStream interface {
+	SourceStream
+
+	// Begin begins an iteration that is committed or aborted explicitly. See Iteration.
+	Begin(ctx context.Context) (Iteration, error)
+}
+
+// Iteration is an iteration of a stream that is begun, committed and aborted explicitly. It is an alternative to
+// sending rows on the stream and calling Complete, and must not be mixed with these on the same stream while it is
+// open. The methods of an iteration return ErrIterationClosed once it has been committed or aborted.
+type Iteration interface {
+	// ID is the ID of the iteration, as recorded in the iteration ledger.
+	ID() string
+
+	// Send sends the given value in the iteration.
+	Send(v bigquery.ValueSaver) error
+
+	// SendAll sends all the elements in the list in the iteration.
+	SendAll(v []bigquery.ValueSaver) error
+
+	// Flush writes all elements currently held in memory to BigQuery, and returns the error of the write, if any.
+	Flush() error
+
+	// Commit waits for the producers registered with Join to be done, and then completes the iteration and returns the
+	// error of the write, if any. Errors are also delivered to the error handler and channel as usual. If the producers
+	// are not done within the timeout set with WithProducerTimeout, or before the context given to Begin is done, the
+	// iteration is aborted and a *ProducerTimeoutError or the error of the context is returned.
+	Commit() error
+
+	// Abort discards the rows buffered for the iteration and deletes the temporary tables that rows have been flushed
+	// to, so that they are not written by a later completion. Rows that have been flushed by an append stream are
+	// already in the target table and remain there.
+	Abort() error
+
+	// Join registers a producer with the iteration, much like WaitGroup.Add(1). Producers sending from several
+	// goroutines join before they start, and call Done when they have sent their last row, so that the iteration is
+	// only committed once every one of them is done.
+	Join() error
+
+	// Done marks a producer registered with Join as done. ErrNoProducers is returned if no producer is registered.
+	Done() error
+}
+
+// ProducerTimeoutError is returned by Iteration.Commit when the producers registered with the iteration are not done
+// within the timeout. The iteration is aborted.
+type ProducerTimeoutError struct {
+	// Pending is the number of producers that were not done.
+	Pending int
+
+	// Timeout is the timeout that expired.
+	Timeout time.Duration
+}
+
+func (e *ProducerTimeoutError) Error() string {
+	return fmt.Sprintf("%d producers were not done within %s", e.Pending, e.Timeout)
+}
+
+// WithProducerTimeout sets how long Iteration.Commit waits for the producers registered with the iteration to be done.
+// Without a timeout, Commit waits until the context given to Begin is done.
+func WithProducerTimeout(timeout time.Duration) StreamOption {
+	return func(collector *streamOptionsCollector) {
+		collector.producerTimeout = timeout
+	}
+}
+
+type iterationCommandOp int
+
+const (
+	commandFlush iterationCommandOp = iota
+	commandComplete
+	commandAbort
+)
+
+// iterationCommand asks the handler of a stream to run the operation, replying with its error.
+type iterationCommand struct {
+	op    iterationCommandOp
+	reply chan error
+}
+
+// Begin begins a new iteration of the stream with a generated ID. ErrIterationOpen is returned if the previous
+// iteration begun on the stream has not been committed or aborted. The context is linked to from the spans of the
+// flushes and the completion of the iteration.
+func (s *streamImpl) Begin(ctx context.Context) (Iteration, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.open {
+		return nil, ErrIterationOpen
+	}
+
+	it := &iteration{stream: s, ctx: ctx, id: newIterationID()}
+	select {
+	case s.iteration <- it.id:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	s.open = true
+	return it, nil
+}
+
+type iteration struct {
+	stream    *streamImpl
+	ctx       context.Context
+	id        string
+	closed    bool
+	producers int
+	waiting   chan struct{}
+}
+
+func (i *iteration) ID() string {
+	return i.id
+}
+
+func (i *iteration) Send(v bigquery.ValueSaver) error {
+	if i.isClosed() {
+		return ErrIterationClosed
+	}
+	i.stream.SendContext(i.ctx, v)
+	return nil
+}
+
+func (i *iteration) SendAll(v []bigquery.ValueSaver) error {
+	if i.isClosed() {
+		return ErrIterationClosed
+	}
+	i.stream.SendAllContext(i.ctx, v)
+	return nil
+}
+
+func (i *iteration) Flush() error {
+	if i.isClosed() {
+		return ErrIterationClosed
+	}
+	return i.run(commandFlush)
+}
+
+func (i *iteration) Commit() error {
+	if err := i.wait(); err != nil {
+		if err != ErrIterationClosed {
+			_ = i.Abort()
+		}
+		return err
+	}
+	if !i.close() {
+		return ErrIterationClosed
+	}
+	i.stream.logComplete()
+	return i.run(commandComplete)
+}
+
+func (i *iteration) Abort() error {
+	if !i.close() {
+		return ErrIterationClosed
+	}
+	return i.run(commandAbort)
+}
+
+func (i *iteration) Join() error {
+	i.stream.mux.Lock()
+	defer i.stream.mux.Unlock()
+	if i.closed {
+		return ErrIterationClosed
+	}
+	i.producers++
+	return nil
+}
+
+func (i *iteration) Done() error {
+	i.stream.mux.Lock()
+	defer i.stream.mux.Unlock()
+	if i.producers == 0 {
+		return ErrNoProducers
+	}
+	i.producers--
+	if i.producers == 0 && i.waiting != nil {
+		close(i.waiting)
+		i.waiting = nil
+	}
+	return nil
+}
+
+// wait waits for the registered producers to be done. Since the waiting ends when the iteration is closed,
+// ErrIterationClosed is returned if it is closed before or during the wait.
+func (i *iteration) wait() error {
+	i.stream.mux.Lock()
+	if i.closed || i.waiting != nil {
+		i.stream.mux.Unlock()
+		return ErrIterationClosed
+	}
+	if i.producers == 0 {
+		i.stream.mux.Unlock()
+		return nil
+	}
+	waiting := make(chan struct{})
+	i.waiting = waiting
+	i.stream.mux.Unlock()
+
+	var expired <-chan time.Time
+	timeout := i.stream.opts.producerTimeout
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	select {
+	case <-waiting:
+		if i.isClosed() {
+			return ErrIterationClosed
+		}
+		return nil
+	case <-expired:
+		i.stream.mux.Lock()
+		defer i.stream.mux.Unlock()
+		return &ProducerTimeoutError{Pending: i.producers, Timeout: timeout}
+	case <-i.ctx.Done():
+		return i.ctx.Err()
+	}
+}
+
+func (i *iteration) isClosed() bool {
+	i.stream.mux.Lock()
+	defer i.stream.mux.Unlock()
+	return i.closed
+}
+
+// close marks the iteration as closed, and returns false if it already was.
+func (i *iteration) close() bool {
+	i.stream.mux.Lock()
+	defer i.stream.mux.Unlock()
+	if i.closed {
+		return false
+	}
+	i.closed = true
+	i.stream.open = false
+	if i.waiting != nil {
+		close(i.waiting)
+		i.waiting = nil
+	}
+	return true
+}
+
+// run has the handler of the stream run the operation, and returns its error.
+func (i *iteration) run(op iterationCommandOp) error {
+	i.stream.links.add(i.ctx)
+	cmd := iterationCommand{op: op, reply: make(chan error, 1)}
+	i.stream.commands <- cmd
+	return <-cmd.reply
+}
+
+// abort discards the current iteration, deleting the temporary tables that rows have been flushed to.
+func (s *streamHandler) abort(ctx context.Context, stream *streamImpl, errorOutput chan<- *ErrorEvent) error {
+	defer s.endIteration()
+
+	var failed error
+	for table, d := range s.destinations {
+		if d.previouslyFlushed && d.tempTable != nil {
+			err := s.operations.DeleteTable(ctx, d.tempTable)
+			if err != nil {
+				e := s.event(err, "while deleting temp table")
+				e.Table = table
+				s.report(e, errorOutput)
+				failed = e
+			} else {
+				s.observer.tempTableDeleted(d.tempCreated)
+			}
+		}
+		if d.load != nil {
+			_ = d.load.close()
+			d.load = nil
+		}
+		d.reset()
+	}
+
+	// The discarded rows must not be replayed from the write-ahead log.
+	s.commit(s.walSeq, errorOutput)
+	s.recordIteration(ctx, IterationAborted, errorOutput)
+	s.logger.Info("iteration aborted",
+		"stream", stream.Type(),
+		"iteration_id", s.iterationID,
+		"rows", s.pending)
+
+	s.pending = 0
+	s.observer.buffered(0)
+	stream.health.buffered(0)
+	return failed
+}
@@ -0,0 +1,415 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/api/googleapi"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrLeaseHeld is returned when a lease is held by another holder.
+var ErrLeaseHeld = errors.New("lease is held by another holder")
+
+// ErrLeaseLost is returned when a lease expired and was acquired again, by another holder or anew, before it was
+// renewed. The fencing token of the lease is then stale, and the work protected by it must not be completed.
+var ErrLeaseLost = errors.New("lease was lost")
+
+// LeaseTokenLabel is the label that the table operations used by default set on the tables they replace under a
+// lease, holding its fencing token.
+const LeaseTokenLabel = "sink_lease_token"
+
+type leaseTokenKey struct{}
+
+// LeaseToken returns the fencing token of the lease under which the operation with the context replaces its table,
+// if any. Implementations of TableOperations may use it to fence their writes, as the ones used by default do with
+// LeaseTokenLabel.
+func LeaseToken(ctx context.Context) (int64, bool) {
+	token, ok := ctx.Value(leaseTokenKey{}).(int64)
+	return token, ok
+}
+
+// checkLeaseToken returns ErrLeaseLost if the table has been labelled with a fencing token newer than the given one,
+// as it is once a later holder of the lease has replaced it.
+func checkLeaseToken(md *bigquery.TableMetadata, token int64) error {
+	label, ok := md.Labels[LeaseTokenLabel]
+	if !ok {
+		return nil
+	}
+	labelled, err := strconv.ParseInt(label, 10, 64)
+	if err != nil {
+		return fmt.Errorf("while reading label %s of %s: %w", LeaseTokenLabel, md.Name, err)
+	}
+	if labelled > token {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// Lease is a lease on a named resource, granted by a Locker.
+type Lease struct {
+	// Name is the name of the resource.
+	Name string
+
+	// Holder identifies the holder of the lease.
+	Holder string
+
+	// Token is the fencing token of the lease. It increases every time the resource is leased anew, so a holder whose
+	// lease has lapsed can tell that it is stale by the token changing.
+	Token int64
+
+	// Expires is when the lease expires unless renewed.
+	Expires time.Time
+}
+
+// Locker grants leases on named resources, so that replicas of a service can coordinate their writes. BigQueryLocker
+// and FileLocker are provided.
+type Locker interface {
+	// Acquire leases the resource to the holder for the duration of the TTL. If the holder already holds an unexpired
+	// lease on the resource, the lease is renewed and keeps its fencing token. ErrLeaseHeld is returned if another
+	// holder holds an unexpired lease on the resource.
+	Acquire(ctx context.Context, name, holder string, ttl time.Duration) (*Lease, error)
+
+	// Release releases the lease, unless it has since been acquired by another holder.
+	Release(ctx context.Context, lease *Lease) error
+}
+
+const (
+	defaultLeaseTTL      = time.Minute
+	defaultLeaseInterval = time.Second
+)
+
+// LeaseOptions configures the leases held by truncate streams while replacing their target tables.
+type LeaseOptions struct {
+	// Locker grants the leases.
+	Locker Locker
+
+	// Holder identifies this replica. Defaults to the host name and process ID.
+	Holder string
+
+	// TTL is how long a lease lasts unless renewed. Defaults to one minute.
+	TTL time.Duration
+
+	// Wait is how long to wait for a lease held by another replica before the completion fails with ErrLeaseHeld.
+	// Defaults to twice the TTL.
+	Wait time.Duration
+
+	// Interval is how often a lease held by another replica is requested while waiting. Defaults to one second.
+	Interval time.Duration
+}
+
+// WithLease makes truncate streams hold a lease on their target table, named after the project, dataset and table,
+// while they check and replace it. Replicas of a service writing the same stream thus replace the table one at a time.
+// The lease is renewed in the background every third of the TTL while it is held, and once more right before the
+// table is replaced. If the lease is lost meanwhile, because it could not be renewed before it expired or its fencing
+// token has changed, the operations against BigQuery are cancelled and the completion fails with ErrLeaseLost, so that
+// a replica that stalled beyond the TTL does not overwrite the data written by another.
+//
+// The table operations used by default also fence the writes in BigQuery, labelling the target table or view with
+// the fencing token under LeaseTokenLabel through updates conditioned on its etag. A replica finding a newer token on
+// the table fails with ErrLeaseLost. View swaps are fenced completely, since the view and its label are updated at
+// once. Copy and load jobs cannot be conditioned, so the label is checked before a job is started and again after it
+// has ended: a job that a stalled replica started before a newer holder labelled the table may still overwrite its
+// data, which the stalled replica then reports as ErrLeaseLost. Tokens must keep increasing for a table, so the label
+// has to be removed if the Locker is replaced by one that counts anew.
+func WithLease(opts LeaseOptions) Option {
+	return func(collector *optionsCollector) {
+		if opts.Holder == "" {
+			host, _ := os.Hostname()
+			opts.Holder = fmt.Sprintf("%s-%d", host, os.Getpid())
+		}
+		if opts.TTL <= 0 {
+			opts.TTL = defaultLeaseTTL
+		}
+		if opts.Wait <= 0 {
+			opts.Wait = 2 * opts.TTL
+		}
+		if opts.Interval <= 0 {
+			opts.Interval = defaultLeaseInterval
+		}
+		collector.lease = &opts
+	}
+}
+
+// leaseRecord is the state of the lease on a resource as kept by a lease store.
+type leaseRecord struct {
+	Holder  string    `json:"holder"`
+	Token   int64     `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// leaseStore keeps the lease records of a storeLocker.
+type leaseStore interface {
+	// update reads the records, applies fn to them and writes the result, atomically with respect to other updates.
+	update(ctx context.Context, fn func(records map[string]leaseRecord) error) error
+}
+
+// storeLocker implements the semantics of a Locker on top of a lease store.
+type storeLocker struct {
+	store leaseStore
+	now   func() time.Time
+}
+
+func (l *storeLocker) Acquire(ctx context.Context, name, holder string, ttl time.Duration) (*Lease, error) {
+	var lease *Lease
+	err := l.store.update(ctx, func(records map[string]leaseRecord) error {
+		now := l.now()
+		r := records[name]
+		held := now.Before(r.Expires)
+		if held && r.Holder != holder {
+			return ErrLeaseHeld
+		}
+		if !held {
+			r.Token++
+		}
+		r.Holder = holder
+		r.Expires = now.Add(ttl)
+		records[name] = r
+		lease = &Lease{Name: name, Holder: holder, Token: r.Token, Expires: r.Expires}
+		return nil
+	})
+	return lease, err
+}
+
+func (l *storeLocker) Release(ctx context.Context, lease *Lease) error {
+	return l.store.update(ctx, func(records map[string]leaseRecord) error {
+		r, ok := records[lease.Name]
+		if !ok || r.Holder != lease.Holder || r.Token != lease.Token {
+			return nil
+		}
+		r.Expires = time.Time{}
+		records[lease.Name] = r
+		return nil
+	})
+}
+
+// FileLocker returns a Locker keeping the leases in a file in the given directory, for replicas running on a single
+// host. Updates are serialized with a lock file created exclusively next to it.
+func FileLocker(dir string) Locker {
+	return &storeLocker{store: &fileLeaseStore{dir: dir}, now: time.Now}
+}
+
+// staleLockFile is the age after which a lock file is considered left behind by a crashed process.
+const staleLockFile = 30 * time.Second
+
+type fileLeaseStore struct {
+	dir string
+}
+
+func (f *fileLeaseStore) update(ctx context.Context, fn func(records map[string]leaseRecord) error) error {
+	lock := filepath.Join(f.dir, "leases.lock")
+	for {
+		lf, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_ = lf.Close()
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > staleLockFile {
+			_ = os.Remove(lock)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	defer os.Remove(lock)
+
+	name := filepath.Join(f.dir, "leases.json")
+	records := map[string]leaseRecord{}
+	b, err := ioutil.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &records); err != nil {
+			return err
+		}
+	}
+
+	if err := fn(records); err != nil {
+		return err
+	}
+
+	b, err = json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// BigQueryLocker returns a Locker keeping the leases as JSON in the description of the given table, which is created
+// without a schema if it does not exist. Updates are serialized by conditioning them on the etag of the table.
+func BigQueryLocker(client *bigquery.Client, datasetID, table string) Locker {
+	return &storeLocker{store: &bigQueryLeaseStore{table: client.Dataset(datasetID).Table(table)}, now: time.Now}
+}
+
+type bigQueryLeaseStore struct {
+	table *bigquery.Table
+}
+
+func (b *bigQueryLeaseStore) update(ctx context.Context, fn func(records map[string]leaseRecord) error) error {
+	for {
+		md, err := b.table.Metadata(ctx)
+		if httpStatus(err) == 404 {
+			err = b.table.Create(ctx, &bigquery.TableMetadata{Description: "{}"})
+			if err != nil && httpStatus(err) != 409 {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		records := map[string]leaseRecord{}
+		if md.Description != "" {
+			if err := json.Unmarshal([]byte(md.Description), &records); err != nil {
+				return fmt.Errorf("while reading leases from %s: %w", b.table.TableID, err)
+			}
+		}
+
+		if err := fn(records); err != nil {
+			return err
+		}
+
+		desc, err := json.Marshal(records)
+		if err != nil {
+			return err
+		}
+		_, err = b.table.Update(ctx, bigquery.TableMetadataToUpdate{Description: string(desc)}, md.ETag)
+		if httpStatus(err) == 412 {
+			// The table was updated by another replica since it was read.
+			continue
+		}
+		return err
+	}
+}
+
+// httpStatus returns the HTTP status code of a BigQuery API error, or 0 if the error is not one.
+func httpStatus(err error) int {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code
+	}
+	return 0
+}
+
+// acquireLease leases the target table of the schema to this replica, waiting while it is held by another. The lease
+// is renewed in the background every third of the TTL until it is released, and the returned context, derived from
+// ctx, is cancelled if the lease is lost meanwhile. The returned fence renews the lease and returns ErrLeaseLost if it
+// has been lost or its token has changed, and release releases it. Unless leases are configured, ctx is returned and
+// the fence and release do nothing.
+func (s *streamHandler) acquireLease(ctx context.Context, schema Schema) (leaseCtx context.Context, fence func() error, release func(), err error) {
+	o := s.lease
+	if o == nil {
+		return ctx, func() error { return nil }, func() {}, nil
+	}
+	name := fmt.Sprintf("%s.%s.%s", schema.ProjectID, s.dataset, schema.BQSchema.Name)
+
+	deadline := time.Now().Add(o.Wait)
+	var lease *Lease
+	for {
+		lease, err = o.Locker.Acquire(ctx, name, o.Holder, o.TTL)
+		if err != ErrLeaseHeld || time.Now().After(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, nil, ctx.Err()
+		case <-time.After(o.Interval):
+		}
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	s.logger.Debug("lease acquired",
+		"stream", s.stream.Type(),
+		"lease", name,
+		"token", lease.Token)
+
+	leaseCtx, cancel := context.WithCancel(context.WithValue(ctx, leaseTokenKey{}, lease.Token))
+	mux := &sync.Mutex{}
+	expires, lost := lease.Expires, false
+
+	// renew renews the lease, and marks it as lost if it has been acquired by another holder or anew, or has expired
+	// before it could be renewed.
+	renew := func() error {
+		renewed, err := o.Locker.Acquire(leaseCtx, name, o.Holder, o.TTL)
+		mux.Lock()
+		defer mux.Unlock()
+		switch {
+		case lost:
+			return ErrLeaseLost
+		case err == nil && renewed.Token == lease.Token:
+			expires = renewed.Expires
+			return nil
+		case err == ErrLeaseHeld || err == nil || !time.Now().Before(expires):
+			lost = true
+			cancel()
+			return ErrLeaseLost
+		}
+		return err
+	}
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(o.TTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if err := renew(); err == ErrLeaseLost {
+				s.logger.Warn("lease lost",
+					"stream", s.stream.Type(),
+					"lease", name,
+					"token", lease.Token)
+				return
+			}
+		}
+	}()
+
+	release = func() {
+		close(stop)
+		<-stopped
+		cancel()
+		if err := o.Locker.Release(ctx, lease); err != nil {
+			s.logger.Warn("failed to release lease",
+				"stream", s.stream.Type(),
+				"lease", name,
+				"error", err)
+		}
+	}
+	return leaseCtx, renew, release, nil
+}
+
+// fenced returns the error of the fence in place of err if the context of the lease is done, so that an operation
+// cancelled since the lease was lost fails with ErrLeaseLost.
+func fenced(leaseCtx context.Context, fence func() error, err error) error {
+	if err == nil || leaseCtx.Err() == nil {
+		return err
+	}
+	if ferr := fence(); ferr != nil {
+		return ferr
+	}
+	return err
+}
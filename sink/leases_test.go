@@ -0,0 +1,73 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"testing"
+	"time"
+)
+
+func Test_FileLocker(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 11, 3, 14, 0, 0, 0, time.UTC)
+	l := FileLocker(t.TempDir()).(*storeLocker)
+	l.now = func() time.Time { return now }
+
+	a, err := l.Acquire(ctx, "readings", "a", time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := l.Acquire(ctx, "readings", "b", time.Minute); err != ErrLeaseHeld {
+		t.Errorf("expected the lease to be held, got %v", err)
+	}
+	if _, err := l.Acquire(ctx, "other", "b", time.Minute); err != nil {
+		t.Errorf("expected leases on other resources to be independent, got %v", err)
+	}
+
+	now = now.Add(30 * time.Second)
+	renewed, err := l.Acquire(ctx, "readings", "a", time.Minute)
+	if err != nil || renewed.Token != a.Token || !renewed.Expires.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected the lease to be renewed with the same token, got %+v, %v", renewed, err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	b, err := l.Acquire(ctx, "readings", "b", time.Minute)
+	if err != nil || b.Token <= a.Token {
+		t.Fatalf("expected the expired lease to be acquired with a new token, got %+v, %v", b, err)
+	}
+
+	// The stale holder cannot release the lease of the new holder.
+	if err := l.Release(ctx, a); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := l.Acquire(ctx, "readings", "a", time.Minute); err != ErrLeaseHeld {
+		t.Errorf("expected the lease to still be held, got %v", err)
+	}
+
+	if err := l.Release(ctx, b); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := l.Acquire(ctx, "readings", "a", time.Minute); err != nil {
+		t.Errorf("expected the released lease to be acquired, got %v", err)
+	}
+}
+
+func Test_checkLeaseToken(t *testing.T) {
+	tests := []struct {
+		labels map[string]string
+		want   error
+	}{
+		{nil, nil},
+		{map[string]string{LeaseTokenLabel: "2"}, nil},
+		{map[string]string{LeaseTokenLabel: "3"}, nil},
+		{map[string]string{LeaseTokenLabel: "4"}, ErrLeaseLost},
+	}
+	for _, tt := range tests {
+		if err := checkLeaseToken(&bigquery.TableMetadata{Labels: tt.labels}, 3); err != tt.want {
+			t.Errorf("checkLeaseToken(%v) = %v, want %v", tt.labels, err, tt.want)
+		}
+	}
+	if err := checkLeaseToken(&bigquery.TableMetadata{Labels: map[string]string{LeaseTokenLabel: "x"}}, 3); err == nil {
+		t.Error("expected an invalid label to be reported")
+	}
+}
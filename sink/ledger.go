@@ -0,0 +1,152 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"fmt"
+	"time"
+)
+
+// LedgerPolicy decides what happens when a producer starts an iteration with an ID that the ledger has already
+// recorded as committed.
+type LedgerPolicy int
+
+const (
+	// LedgerSkip discards the rows of an iteration that has already been committed. The outcome is recorded after the
+	// iteration has been written, so an iteration whose write succeeded but whose outcome was never recorded, such as
+	// when the process crashed in between, is written again by a re-run.
+	LedgerSkip LedgerPolicy = iota
+
+	// LedgerReplace writes the iteration again. For truncate streams, this replaces the previously committed data.
+	// Append streams have no way of removing the rows of the previous attempt, so they are written once more.
+	LedgerReplace
+)
+
+const (
+	// IterationCommitted is the ledger status of an iteration that was written successfully.
+	IterationCommitted = "COMMITTED"
+
+	// IterationFailed is the ledger status of an iteration where at least one write failed.
+	IterationFailed = "FAILED"
+
+	// IterationSkipped is the ledger status of an iteration that was discarded since it had already been committed.
+	IterationSkipped = "SKIPPED"
+
+	// IterationAborted is the ledger status of an iteration that was discarded by Iteration.Abort.
+	IterationAborted = "ABORTED"
+)
+
+type ledgerOptions struct {
+	table  string
+	policy LedgerPolicy
+}
+
+// ledgerEntry is a row in the ledger table.
+type ledgerEntry struct {
+	stream      string
+	iterationID string
+	rows        int
+	status      string
+	startedAt   time.Time
+	finishedAt  time.Time
+}
+
+func (e *ledgerEntry) Save() (map[string]bigquery.Value, string, error) {
+	return map[string]bigquery.Value{
+		"stream":       e.stream,
+		"iteration_id": e.iterationID,
+		"rows":         e.rows,
+		"status":       e.status,
+		"started_at":   e.startedAt,
+		"finished_at":  e.finishedAt,
+	}, "", nil
+}
+
+// ledgerSchema returns the schema of the ledger table in the dataset written to by the stream schema.
+func ledgerSchema(table string, s Schema) Schema {
+	return Schema{
+		BQSchema: &bigquery.TableMetadata{
+			Name:        table,
+			Description: "Outcome of the iterations written by the sink",
+			Schema: bigquery.Schema{
+				{Name: "stream", Type: bigquery.StringFieldType, Required: true},
+				{Name: "iteration_id", Type: bigquery.StringFieldType, Required: true},
+				{Name: "rows", Type: bigquery.IntegerFieldType},
+				{Name: "status", Type: bigquery.StringFieldType, Required: true},
+				{Name: "started_at", Type: bigquery.TimestampFieldType},
+				{Name: "finished_at", Type: bigquery.TimestampFieldType},
+			},
+		},
+		Disposition: bigquery.WriteAppend,
+		ProjectID:   s.ProjectID,
+		DatasetID:   s.DatasetID,
+		KMSKeyName:  s.KMSKeyName,
+	}
+}
+
+// ledgerTable creates the ledger table if needed and returns a reference to it.
+func (s *streamHandler) ledgerTable(ctx context.Context) (*bigquery.Table, error) {
+	schema := ledgerSchema(s.ledger.table, s.stream.schema)
+	if s.ledgerRef == nil {
+		t, err := s.operations.CreateTable(ctx, s.dataset, schema)
+		if err != nil {
+			return nil, err
+		}
+		s.ledgerRef = t
+	}
+	return s.ledgerRef, nil
+}
+
+// committed returns true if the ledger holds a committed entry for the stream and the iteration ID. The ledger is
+// queried for the entries of the iteration only, unless this handler has committed the iteration itself.
+func (s *streamHandler) committed(ctx context.Context, iterationID string) (bool, error) {
+	if s.ledgerStatus[iterationID] == IterationCommitted {
+		return true, nil
+	}
+	q, ok := s.operations.(QueryOperations)
+	if !ok {
+		return false, errQueriesUnsupported
+	}
+	table, err := s.ledgerTable(ctx)
+	if err != nil {
+		return false, err
+	}
+	sql := fmt.Sprintf("SELECT 1 FROM `%s.%s.%s` WHERE stream = @stream AND iteration_id = @iteration_id AND status = @status LIMIT 1",
+		table.ProjectID, table.DatasetID, table.TableID)
+	rows, err := q.Query(ctx, table.ProjectID, sql,
+		bigquery.QueryParameter{Name: "stream", Value: s.stream.Type()},
+		bigquery.QueryParameter{Name: "iteration_id", Value: iterationID},
+		bigquery.QueryParameter{Name: "status", Value: IterationCommitted})
+	if err != nil {
+		return false, err
+	}
+	return len(rows) > 0, nil
+}
+
+// record writes the outcome of the current iteration to the ledger. This is not atomic with the write of the
+// iteration, which has completed by the time its outcome is recorded.
+func (s *streamHandler) record(ctx context.Context, status string) error {
+	table, err := s.ledgerTable(ctx)
+	if err != nil {
+		return err
+	}
+	e := &ledgerEntry{
+		stream:      s.stream.Type(),
+		iterationID: s.iterationID,
+		rows:        s.iterationRows,
+		status:      status,
+		startedAt:   s.iterationStart,
+		finishedAt:  time.Now().UTC(),
+	}
+	err = s.operations.Write(ctx, table, []bigquery.ValueSaver{e})
+	if err != nil {
+		return err
+	}
+	if status == IterationCommitted {
+		if s.ledgerStatus == nil {
+			s.ledgerStatus = map[string]string{}
+		}
+		s.ledgerStatus[s.iterationID] = status
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"os"
+	"time"
+)
+
+// WriteMethod decides how the rows of a stream are written to BigQuery.
+type WriteMethod string
+
+const (
+	// StreamingInsert writes rows with the streaming insert API. This is the default.
+	StreamingInsert WriteMethod = ""
+
+	// LoadJob writes rows by serializing them to newline delimited JSON and running a load job with the disposition
+	// of the stream directly against the target table. For truncate streams, the rows of the whole iteration are
+	// loaded when the iteration completes, so no temporary table is used.
+	LoadJob WriteMethod = "LOAD_JOB"
+)
+
+// Loader is the load-capable extension of TableOperations, needed by streams using the LoadJob write method. The table
+// operations used by default implement it.
+type Loader interface {
+	// Load runs a load job that writes the newline delimited JSON rows read from source to the table with the given
+	// disposition.
+	Load(ctx context.Context, table *bigquery.Table, source io.Reader, schema Schema, disposition bigquery.TableWriteDisposition) error
+}
+
+// errLoadUnsupported is returned when a stream uses the LoadJob write method but the table operations cannot run load
+// jobs.
+var errLoadUnsupported = errors.New("table operations do not implement Loader")
+
+// loadBuffer holds the serialized rows of a load job, either in memory or in a file in a spool directory.
+type loadBuffer struct {
+	file *os.File
+	buf  *bytes.Buffer
+	w    *bufio.Writer
+	rows int
+}
+
+func newLoadBuffer(dir string) (*loadBuffer, error) {
+	if dir == "" {
+		buf := &bytes.Buffer{}
+		return &loadBuffer{buf: buf, w: bufio.NewWriter(buf)}, nil
+	}
+	f, err := os.CreateTemp(dir, "sink-*.ndjson")
+	if err != nil {
+		return nil, err
+	}
+	return &loadBuffer{file: f, w: bufio.NewWriter(f)}, nil
+}
+
+// append serializes the rows to the buffer.
+func (b *loadBuffer) append(schema bigquery.Schema, rows []bigquery.ValueSaver) error {
+	n, err := writeNDJSON(b.w, schema, rows)
+	b.rows += n
+	return err
+}
+
+// reader flushes the buffer and returns a reader positioned at the first row.
+func (b *loadBuffer) reader() (io.Reader, error) {
+	if err := b.w.Flush(); err != nil {
+		return nil, err
+	}
+	if b.file == nil {
+		return bytes.NewReader(b.buf.Bytes()), nil
+	}
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return b.file, nil
+}
+
+// close releases the buffer, removing the spool file if any.
+func (b *loadBuffer) close() error {
+	if b.file == nil {
+		return nil
+	}
+	_ = b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// writeNDJSON writes the rows as newline delimited JSON, formatting each value as expected by BigQuery for the type of
+// its column. The number of rows written is returned.
+func writeNDJSON(w io.Writer, schema bigquery.Schema, rows []bigquery.ValueSaver) (int, error) {
+	enc := json.NewEncoder(w)
+	for i, r := range rows {
+		row, _, err := r.Save()
+		if err != nil {
+			return i, err
+		}
+		if err := enc.Encode(encodeRecord(schema, row)); err != nil {
+			return i, err
+		}
+	}
+	return len(rows), nil
+}
+
+// spooledTimestampLayout is the layout of TIMESTAMP values when serialized for load jobs, spools and the write-ahead
+// log.
+const spooledTimestampLayout = "2006-01-02 15:04:05.999999 UTC"
+
+func encodeRecord(schema bigquery.Schema, row map[string]bigquery.Value) map[string]interface{} {
+	fields := map[string]*bigquery.FieldSchema{}
+	for _, f := range schema {
+		fields[f.Name] = f
+	}
+	m := make(map[string]interface{}, len(row))
+	for k, v := range row {
+		f, ok := fields[k]
+		if !ok {
+			m[k] = v
+			continue
+		}
+		m[k] = encodeField(f, v)
+	}
+	return m
+}
+
+func encodeField(f *bigquery.FieldSchema, v bigquery.Value) interface{} {
+	if !f.Repeated {
+		return encodeValue(f, v)
+	}
+	var list []interface{}
+	switch vs := v.(type) {
+	case []bigquery.Value:
+		for _, e := range vs {
+			list = append(list, encodeValue(f, e))
+		}
+	case []interface{}:
+		for _, e := range vs {
+			list = append(list, encodeValue(f, e))
+		}
+	default:
+		return v
+	}
+	return list
+}
+
+func encodeValue(f *bigquery.FieldSchema, v bigquery.Value) interface{} {
+	switch x := v.(type) {
+	case time.Time:
+		switch f.Type {
+		case bigquery.DateFieldType:
+			return civil.DateOf(x).String()
+		case bigquery.TimeFieldType:
+			return bigquery.CivilTimeString(civil.TimeOf(x))
+		case bigquery.DateTimeFieldType:
+			return bigquery.CivilDateTimeString(civil.DateTimeOf(x))
+		default:
+			return x.UTC().Format(spooledTimestampLayout)
+		}
+	case civil.Date:
+		return x.String()
+	case civil.Time:
+		return bigquery.CivilTimeString(x)
+	case civil.DateTime:
+		return bigquery.CivilDateTimeString(x)
+	case *big.Rat:
+		if f.Type == bigquery.BigNumericFieldType {
+			return bigquery.BigNumericString(x)
+		}
+		return bigquery.NumericString(x)
+	case map[string]bigquery.Value:
+		if f.Type == bigquery.RecordFieldType {
+			return encodeRecord(f.Schema, x)
+		}
+	}
+	return v
+}
@@ -0,0 +1,52 @@
+package sink
+
+import (
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func Test_writeNDJSON(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "ts", Type: bigquery.TimestampFieldType},
+		{Name: "time", Type: bigquery.TimeFieldType},
+		{Name: "date", Type: bigquery.DateFieldType},
+		{Name: "amount", Type: bigquery.NumericFieldType},
+		{Name: "tags", Type: bigquery.StringFieldType, Repeated: true},
+		{Name: "meter", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "installed", Type: bigquery.DateFieldType},
+		}},
+	}
+	ts := time.Date(2026, 10, 17, 9, 16, 1, 123456000, time.UTC)
+	rows := []bigquery.ValueSaver{
+		&savedRow{row: map[string]bigquery.Value{
+			"ts":     ts,
+			"time":   ts,
+			"date":   civil.DateOf(ts),
+			"amount": big.NewRat(3, 2),
+			"tags":   []bigquery.Value{"a", "b"},
+			"meter":  map[string]bigquery.Value{"installed": ts},
+			"extra":  1,
+		}},
+		&savedRow{row: map[string]bigquery.Value{"ts": nil}},
+	}
+
+	buf := &bytes.Buffer{}
+	n, err := writeNDJSON(buf, schema, rows)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if n != 2 {
+		t.Errorf("unexpected number of rows written, got %d", n)
+	}
+
+	want := `{"amount":"1.500000000","date":"2026-10-17","extra":1,"meter":{"installed":"2026-10-17"},"tags":["a","b"],"time":"09:16:01.123456","ts":"2026-10-17 09:16:01.123456 UTC"}
+{"ts":null}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("writeNDJSON() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,48 @@
+package sink
+
+import (
+	"context"
+	"sync"
+)
+
+// Logger is the interface through which this package logs. The arguments following the message are alternating keys
+// and values, such as "stream", "readings", "rows", 42. The interface is satisfied by *slog.Logger, and adapters for
+// other structured logging libraries are easily written. Nothing is logged unless a logger is set with WithLogger.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
+
+type jobsKey struct{}
+
+// jobIDs collects the IDs of the BigQuery jobs run with a context, so that they can be logged.
+type jobIDs struct {
+	mux *sync.Mutex
+	ids []string
+}
+
+func withJobIDs(ctx context.Context) (context.Context, *jobIDs) {
+	jobs := &jobIDs{mux: &sync.Mutex{}}
+	return context.WithValue(ctx, jobsKey{}, jobs), jobs
+}
+
+func (j *jobIDs) add(id string) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	j.ids = append(j.ids, id)
+}
+
+func (j *jobIDs) list() []string {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	return append([]string(nil), j.ids...)
+}
@@ -0,0 +1,278 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"github.com/3lvia/metrics-go/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics is the interface through which this package records metrics. The names of the metrics are listed in the
+// README, and the labels of a metric always have the same keys. Adapters are provided for the module
+// github.com/3lvia/metrics-go, the Prometheus client and OpenTelemetry. Nothing is recorded unless an implementation
+// is set with WithMetrics.
+type Metrics interface {
+	// AddCounter adds the value to the counter with the given name and labels.
+	AddCounter(name string, labels map[string]string, v float64)
+
+	// SetGauge sets the gauge with the given name and labels to the value.
+	SetGauge(name string, labels map[string]string, v float64)
+
+	// ObserveHistogram records the value in the histogram with the given name and labels.
+	ObserveHistogram(name string, labels map[string]string, v float64)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) AddCounter(name string, labels map[string]string, v float64)       {}
+func (nopMetrics) SetGauge(name string, labels map[string]string, v float64)         {}
+func (nopMetrics) ObserveHistogram(name string, labels map[string]string, v float64) {}
+
+type metricDefinition struct {
+	help    string
+	buckets []float64
+}
+
+var metricDefinitions = map[string]metricDefinition{
+	metricsReceived:          {help: "Rows received on the stream."},
+	metricsFlushed:           {help: "Rows written to BigQuery."},
+	metricsDuplicates:        {help: "Rows dropped since their insertID had already been received in the iteration."},
+	metricsErrors:            {help: "Errors by the step that failed and the class of the error."},
+	metricsBytesWritten:      {help: "Bytes of JSON encoded rows per write to BigQuery, estimated for streaming inserts.", buckets: prometheus.ExponentialBuckets(1024, 4, 10)},
+	metricsOperationDuration: {help: "Duration of the individual operations against BigQuery.", buckets: prometheus.ExponentialBuckets(0.01, 2, 14)},
+	metricsFlushDuration:     {help: "Duration of whole flushes and completions of a stream.", buckets: prometheus.ExponentialBuckets(0.01, 2, 16)},
+	metricsFlushRows:         {help: "Number of rows written per destination table in a flush or completion.", buckets: prometheus.ExponentialBuckets(1, 4, 12)},
+	metricsTempTableLifetime: {help: "Time from the creation to the deletion of temporary tables.", buckets: prometheus.ExponentialBuckets(1, 2, 16)},
+	metricsBufferedRows:      {help: "Rows received but not yet written, in memory and spooled."},
+	metricsErrorsDropped:     {help: "Error events dropped since the error queue was full."},
+	metricsGuardTrips:        {help: "Iterations rejected by a truncate guard."},
+	metricsAssertions:        {help: "Assertions run against temporary tables by result."},
+	metricsSnapshots:         {help: "Snapshots taken of target tables before they were replaced."},
+	metricsInvalidRows:       {help: "Rows rejected by coercion or validation against the schema."},
+	metricsTransformedRows:   {help: "Rows passed to transformers by whether they were passed on, filtered, split or rejected."},
+}
+
+// labelKey returns a key identifying the name and labels of a metric.
+func labelKey(name string, labels map[string]string) string {
+	keys := labelNames(labels)
+	key := name
+	for _, k := range keys {
+		key += "," + k + "=" + labels[k]
+	}
+	return key
+}
+
+func labelNames(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MetricsGo adapts the metrics service of the module github.com/3lvia/metrics-go. Counters are kept in the metrics
+// service with the label day added, while gauges and histograms, which the metrics service does not support with
+// labels, are registered with the given Prometheus registerer.
+func MetricsGo(m metrics.Metrics, reg prometheus.Registerer) Metrics {
+	return &metricsGoMetrics{
+		Metrics:  PrometheusMetrics(reg),
+		m:        m,
+		mux:      &sync.Mutex{},
+		counters: map[string]metrics.Counter{},
+	}
+}
+
+type metricsGoMetrics struct {
+	Metrics
+	m        metrics.Metrics
+	mux      *sync.Mutex
+	counters map[string]metrics.Counter
+}
+
+// AddCounter adds to the counter in the metrics service. Counters are cached here since the metrics service does not
+// recognise a label map with more than one entry as one it has already registered.
+func (g *metricsGoMetrics) AddCounter(name string, labels map[string]string, v float64) {
+	dayLabels := metrics.DayLabels()
+	for k, l := range labels {
+		dayLabels[k] = l
+	}
+	key := labelKey(name, dayLabels)
+
+	g.mux.Lock()
+	c, ok := g.counters[key]
+	if !ok {
+		c = g.m.Counter(name, dayLabels)
+		g.counters[key] = c
+	}
+	g.mux.Unlock()
+
+	c.Add(v)
+}
+
+// PrometheusMetrics registers the metrics with the given Prometheus registerer. Metrics already registered by an
+// earlier call are reused.
+func PrometheusMetrics(reg prometheus.Registerer) Metrics {
+	return &prometheusMetrics{reg: reg, mux: &sync.Mutex{}, vecs: map[string]prometheus.Collector{}}
+}
+
+type prometheusMetrics struct {
+	reg  prometheus.Registerer
+	mux  *sync.Mutex
+	vecs map[string]prometheus.Collector
+}
+
+func (p *prometheusMetrics) AddCounter(name string, labels map[string]string, v float64) {
+	vec, ok := p.collector(name, labels, func(opts prometheus.Opts, names []string) prometheus.Collector {
+		return prometheus.NewCounterVec(prometheus.CounterOpts(opts), names)
+	}).(*prometheus.CounterVec)
+	if !ok {
+		return
+	}
+	if c, err := vec.GetMetricWith(labels); err == nil {
+		c.Add(v)
+	}
+}
+
+func (p *prometheusMetrics) SetGauge(name string, labels map[string]string, v float64) {
+	vec, ok := p.collector(name, labels, func(opts prometheus.Opts, names []string) prometheus.Collector {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts(opts), names)
+	}).(*prometheus.GaugeVec)
+	if !ok {
+		return
+	}
+	if g, err := vec.GetMetricWith(labels); err == nil {
+		g.Set(v)
+	}
+}
+
+func (p *prometheusMetrics) ObserveHistogram(name string, labels map[string]string, v float64) {
+	vec, ok := p.collector(name, labels, func(opts prometheus.Opts, names []string) prometheus.Collector {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    opts.Name,
+			Help:    opts.Help,
+			Buckets: metricDefinitions[name].buckets,
+		}, names)
+	}).(*prometheus.HistogramVec)
+	if !ok {
+		return
+	}
+	if h, err := vec.GetMetricWith(labels); err == nil {
+		h.Observe(v)
+	}
+}
+
+// collector returns the vector with the given name, creating and registering it if needed. If a vector with the name
+// has already been registered, it is used instead. Nil is returned if the vector cannot be registered.
+func (p *prometheusMetrics) collector(name string, labels map[string]string, create func(opts prometheus.Opts, names []string) prometheus.Collector) prometheus.Collector {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if c, ok := p.vecs[name]; ok {
+		return c
+	}
+	help := metricDefinitions[name].help
+	if help == "" {
+		help = strings.ReplaceAll(name, "_", " ")
+	}
+	c := create(prometheus.Opts{Name: name, Help: help}, labelNames(labels))
+	if err := p.reg.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if !errors.As(err, &are) {
+			c = nil
+		} else {
+			c = are.ExistingCollector
+		}
+	}
+	p.vecs[name] = c
+	return c
+}
+
+// OpenTelemetryMetrics records the metrics with instruments created from the given meter. Gauges are recorded with
+// up-down counters.
+func OpenTelemetryMetrics(meter metric.Meter) Metrics {
+	return &otelMetrics{
+		meter:      meter,
+		mux:        &sync.Mutex{},
+		counters:   map[string]metric.Float64Counter{},
+		gauges:     map[string]metric.Float64UpDownCounter{},
+		histograms: map[string]metric.Float64Histogram{},
+		last:       map[string]float64{},
+	}
+}
+
+type otelMetrics struct {
+	meter      metric.Meter
+	mux        *sync.Mutex
+	counters   map[string]metric.Float64Counter
+	gauges     map[string]metric.Float64UpDownCounter
+	histograms map[string]metric.Float64Histogram
+	last       map[string]float64
+}
+
+func (o *otelMetrics) AddCounter(name string, labels map[string]string, v float64) {
+	o.mux.Lock()
+	c, ok := o.counters[name]
+	if !ok {
+		var err error
+		c, err = o.meter.NewFloat64Counter(name, metric.WithDescription(metricDefinitions[name].help))
+		if err != nil {
+			o.mux.Unlock()
+			return
+		}
+		o.counters[name] = c
+	}
+	o.mux.Unlock()
+
+	c.Add(context.Background(), v, attributes(labels)...)
+}
+
+func (o *otelMetrics) SetGauge(name string, labels map[string]string, v float64) {
+	o.mux.Lock()
+	g, ok := o.gauges[name]
+	if !ok {
+		var err error
+		g, err = o.meter.NewFloat64UpDownCounter(name, metric.WithDescription(metricDefinitions[name].help))
+		if err != nil {
+			o.mux.Unlock()
+			return
+		}
+		o.gauges[name] = g
+	}
+	key := labelKey(name, labels)
+	delta := v - o.last[key]
+	o.last[key] = v
+	o.mux.Unlock()
+
+	g.Add(context.Background(), delta, attributes(labels)...)
+}
+
+func (o *otelMetrics) ObserveHistogram(name string, labels map[string]string, v float64) {
+	o.mux.Lock()
+	h, ok := o.histograms[name]
+	if !ok {
+		var err error
+		h, err = o.meter.NewFloat64Histogram(name, metric.WithDescription(metricDefinitions[name].help))
+		if err != nil {
+			o.mux.Unlock()
+			return
+		}
+		o.histograms[name] = h
+	}
+	o.mux.Unlock()
+
+	h.Record(context.Background(), v, attributes(labels)...)
+}
+
+func attributes(labels map[string]string) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(labels))
+	for _, k := range labelNames(labels) {
+		attrs = append(attrs, attribute.String(k, labels[k]))
+	}
+	return attrs
+}
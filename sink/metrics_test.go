@@ -0,0 +1,67 @@
+package sink
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/metric/metrictest"
+	"testing"
+)
+
+func Test_PrometheusMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := PrometheusMetrics(reg)
+
+	labels := map[string]string{"stream": "readings", "table": "t1"}
+	m.AddCounter(metricsFlushed, labels, 2)
+	m.AddCounter(metricsFlushed, labels, 3)
+	m.SetGauge(metricsBufferedRows, map[string]string{"stream": "readings"}, 7)
+	m.ObserveHistogram(metricsFlushRows, map[string]string{"stream": "readings"}, 5)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(families) != 3 {
+		t.Errorf("unexpected number of metrics, got %d", len(families))
+	}
+
+	// A second adapter on the same registry reuses the registered metrics.
+	other := PrometheusMetrics(reg)
+	other.AddCounter(metricsFlushed, labels, 1)
+
+	flushed := m.(*prometheusMetrics).vecs[metricsFlushed].(*prometheus.CounterVec)
+	if v := testutil.ToFloat64(flushed.With(labels)); v != 6 {
+		t.Errorf("unexpected counter value, got %f", v)
+	}
+	buffered := m.(*prometheusMetrics).vecs[metricsBufferedRows].(*prometheus.GaugeVec)
+	if v := testutil.ToFloat64(buffered.WithLabelValues("readings")); v != 7 {
+		t.Errorf("unexpected gauge value, got %f", v)
+	}
+}
+
+func Test_OpenTelemetryMetrics(t *testing.T) {
+	provider := metrictest.NewMeterProvider()
+	m := OpenTelemetryMetrics(provider.Meter("test"))
+
+	labels := map[string]string{"stream": "readings"}
+	m.AddCounter(metricsReceived, labels, 1)
+	m.SetGauge(metricsBufferedRows, labels, 5)
+	m.SetGauge(metricsBufferedRows, labels, 2)
+	m.ObserveHistogram(metricsFlushRows, labels, 3)
+
+	var values []float64
+	for _, b := range provider.MeasurementBatches {
+		for _, measurement := range b.Measurements {
+			values = append(values, measurement.Number.AsFloat64())
+		}
+	}
+	want := []float64{1, 5, -3, 3}
+	if len(values) != len(want) {
+		t.Fatalf("unexpected measurements, got %v", values)
+	}
+	for i := range want {
+		if values[i] != want[i] {
+			t.Errorf("unexpected measurement %d, got %f", i, values[i])
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/googleapi"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	metricsReceived          = `sink_received`
+	metricsFlushed           = `sink_flushed`
+	metricsDuplicates        = `sink_duplicates`
+	metricsErrors            = `sink_errors`
+	metricsBytesWritten      = `sink_written_bytes`
+	metricsOperationDuration = `sink_operation_duration_seconds`
+	metricsFlushDuration     = `sink_flush_duration_seconds`
+	metricsFlushRows         = `sink_flush_rows`
+	metricsTempTableLifetime = `sink_temp_table_lifetime_seconds`
+	metricsBufferedRows      = `sink_buffered_rows`
+)
+
+// observer records the metrics of a single stream, labelled by stream.
+type observer struct {
+	stream  string
+	metrics Metrics
+}
+
+func newObserver(stream string, m Metrics) *observer {
+	return &observer{stream: stream, metrics: m}
+}
+
+func (o *observer) labels(kv ...string) map[string]string {
+	labels := map[string]string{"stream": o.stream}
+	for i := 0; i+1 < len(kv); i += 2 {
+		labels[kv[i]] = kv[i+1]
+	}
+	return labels
+}
+
+func (o *observer) received() {
+	o.metrics.AddCounter(metricsReceived, o.labels(), 1)
+}
+
+func (o *observer) duplicate() {
+	o.metrics.AddCounter(metricsDuplicates, o.labels(), 1)
+}
+
+func (o *observer) flushed(table string, rows int) {
+	o.metrics.AddCounter(metricsFlushed, o.labels("table", table), float64(rows))
+	o.metrics.ObserveHistogram(metricsFlushRows, o.labels(), float64(rows))
+}
+
+func (o *observer) errored(step, class string) {
+	o.metrics.AddCounter(metricsErrors, o.labels("step", step, "class", class), 1)
+}
+
+func (o *observer) flushDone(op string, started time.Time) {
+	o.metrics.ObserveHistogram(metricsFlushDuration, o.labels("op", op), time.Since(started).Seconds())
+}
+
+func (o *observer) operation(op string, started time.Time) {
+	o.metrics.ObserveHistogram(metricsOperationDuration, o.labels("operation", op), time.Since(started).Seconds())
+}
+
+func (o *observer) written(table string, bytes int) {
+	o.metrics.ObserveHistogram(metricsBytesWritten, o.labels("table", table), float64(bytes))
+}
+
+func (o *observer) tempTableDeleted(created time.Time) {
+	o.metrics.ObserveHistogram(metricsTempTableLifetime, o.labels(), time.Since(created).Seconds())
+}
+
+func (o *observer) guardTripped(guard string) {
+	o.metrics.AddCounter(metricsGuardTrips, o.labels("guard", guard), 1)
+}
+
+func (o *observer) asserted(assertion string, passed bool) {
+	result := "passed"
+	if !passed {
+		result = "failed"
+	}
+	o.metrics.AddCounter(metricsAssertions, o.labels("assertion", assertion, "result", result), 1)
+}
+
+func (o *observer) snapshotTaken() {
+	o.metrics.AddCounter(metricsSnapshots, o.labels(), 1)
+}
+
+func (o *observer) invalid() {
+	o.metrics.AddCounter(metricsInvalidRows, o.labels(), 1)
+}
+
+func (o *observer) transformed(transformer, result string) {
+	o.metrics.AddCounter(metricsTransformedRows, o.labels("transformer", transformer, "result", result), 1)
+}
+
+func (o *observer) buffered(rows int) {
+	o.metrics.SetGauge(metricsBufferedRows, o.labels(), float64(rows))
+}
+
+// stepName turns an error context such as "while writing to temporary table" into a label value.
+func stepName(msg string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(msg, "while "), " ", "_")
+}
+
+// errorClass classifies the error for use as a label value.
+func errorClass(err error) string {
+	if errors.Is(err, context.Canceled) {
+		return "canceled"
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch {
+		case gerr.Code == 404:
+			return "not_found"
+		case gerr.Code == 409:
+			return "conflict"
+		case gerr.Code == 429 || (gerr.Code == 403 && strings.Contains(gerr.Message, "rate")):
+			return "rate_limit"
+		case gerr.Code == 403:
+			return "permission"
+		case gerr.Code >= 500:
+			return "server"
+		case gerr.Code >= 400:
+			return "invalid"
+		}
+	}
+	var multi bigquery.PutMultiError
+	if errors.As(err, &multi) {
+		return "row"
+	}
+	return "other"
+}
+
+// instrumentedOperations records the duration of every call to the wrapped table operations, and the number of bytes
+// written. Each call is traced as a child span of the span in the context, and reported as the
+// current step of the stream's health.
+type instrumentedOperations struct {
+	TableOperations
+	observer *observer
+	tracer   trace.Tracer
+	health   *healthState
+}
+
+// begin starts the span of an operation. The returned function ends it and records the duration.
+func (o *instrumentedOperations) begin(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	started := time.Now()
+	leave := o.health.enter(op)
+	ctx, span := o.tracer.Start(ctx, "bigquery."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(append(attrs, attrStream.String(o.observer.stream))...))
+	return ctx, func(err error) {
+		o.observer.operation(op, started)
+		leave()
+		endSpan(span, err)
+	}
+}
+
+func (o *instrumentedOperations) Write(ctx context.Context, table *bigquery.Table, rows []bigquery.ValueSaver) error {
+	ctx, end := o.begin(ctx, "write", append(tableAttributes(table), attrRows.Int(len(rows)))...)
+	err := o.TableOperations.Write(ctx, table, rows)
+	if err == nil {
+		o.observer.written(table.TableID, insertSize(rows))
+	}
+	end(err)
+	return err
+}
+
+func (o *instrumentedOperations) CreateTable(ctx context.Context, dataset string, schema Schema) (*bigquery.Table, error) {
+	ctx, end := o.begin(ctx, "create_table", attrProject.String(schema.ProjectID), attrDataset.String(dataset), attrTable.String(schema.BQSchema.Name))
+	table, err := o.TableOperations.CreateTable(ctx, dataset, schema)
+	end(err)
+	return table, err
+}
+
+func (o *instrumentedOperations) CopyTable(ctx context.Context, source, dest *bigquery.Table) error {
+	ctx, end := o.begin(ctx, "copy_table", tableAttributes(dest)...)
+	err := o.TableOperations.CopyTable(ctx, source, dest)
+	end(err)
+	return err
+}
+
+// CopyTableEncrypted copies the table if the wrapped table operations implement EncryptedCopier.
+func (o *instrumentedOperations) CopyTableEncrypted(ctx context.Context, source, dest *bigquery.Table, encryption *bigquery.EncryptionConfig) error {
+	c, ok := o.TableOperations.(EncryptedCopier)
+	if !ok {
+		return errEncryptionUnsupported
+	}
+	ctx, end := o.begin(ctx, "copy_table", tableAttributes(dest)...)
+	err := c.CopyTableEncrypted(ctx, source, dest, encryption)
+	end(err)
+	return err
+}
+
+func (o *instrumentedOperations) DeleteTable(ctx context.Context, table *bigquery.Table) error {
+	ctx, end := o.begin(ctx, "delete_table", tableAttributes(table)...)
+	err := o.TableOperations.DeleteTable(ctx, table)
+	end(err)
+	return err
+}
+
+// Load runs the load job if the wrapped table operations implement Loader.
+func (o *instrumentedOperations) Load(ctx context.Context, table *bigquery.Table, source io.Reader, schema Schema, disposition bigquery.TableWriteDisposition) error {
+	l, ok := o.TableOperations.(Loader)
+	if !ok {
+		return errLoadUnsupported
+	}
+	ctx, end := o.begin(ctx, "load", tableAttributes(table)...)
+	counter := &countingReader{r: source}
+	err := l.Load(ctx, table, counter, schema, disposition)
+	if err == nil {
+		o.observer.written(table.TableID, counter.n)
+	}
+	end(err)
+	return err
+}
+
+// Metadata fetches the metadata if the wrapped table operations implement MetadataReader.
+func (o *instrumentedOperations) Metadata(ctx context.Context, table *bigquery.Table) (*bigquery.TableMetadata, error) {
+	r, ok := o.TableOperations.(MetadataReader)
+	if !ok {
+		return nil, errMetadataUnsupported
+	}
+	ctx, end := o.begin(ctx, "metadata", tableAttributes(table)...)
+	md, err := r.Metadata(ctx, table)
+	end(err)
+	return md, err
+}
+
+// Query runs the query if the wrapped table operations implement QueryOperations.
+func (o *instrumentedOperations) Query(ctx context.Context, projectID, sql string, params ...bigquery.QueryParameter) ([]map[string]bigquery.Value, error) {
+	q, ok := o.TableOperations.(QueryOperations)
+	if !ok {
+		return nil, errQueriesUnsupported
+	}
+	ctx, end := o.begin(ctx, "query", attrProject.String(projectID))
+	rows, err := q.Query(ctx, projectID, sql, params...)
+	end(err)
+	return rows, err
+}
+
+// Snapshot takes the snapshot if the wrapped table operations implement SnapshotOperations.
+func (o *instrumentedOperations) Snapshot(ctx context.Context, source, snapshot *bigquery.Table, expiration time.Time) error {
+	ops, ok := o.TableOperations.(SnapshotOperations)
+	if !ok {
+		return errSnapshotsUnsupported
+	}
+	ctx, end := o.begin(ctx, "snapshot", tableAttributes(source)...)
+	err := ops.Snapshot(ctx, source, snapshot, expiration)
+	end(err)
+	return err
+}
+
+// Restore restores the table if the wrapped table operations implement SnapshotOperations.
+func (o *instrumentedOperations) Restore(ctx context.Context, snapshot, dest *bigquery.Table, encryption *bigquery.EncryptionConfig) error {
+	ops, ok := o.TableOperations.(SnapshotOperations)
+	if !ok {
+		return errSnapshotsUnsupported
+	}
+	ctx, end := o.begin(ctx, "restore", tableAttributes(dest)...)
+	err := ops.Restore(ctx, snapshot, dest, encryption)
+	end(err)
+	return err
+}
+
+// ListTables lists the tables if the wrapped table operations implement SnapshotOperations.
+func (o *instrumentedOperations) ListTables(ctx context.Context, projectID, datasetID, prefix string) ([]*bigquery.Table, error) {
+	ops, ok := o.TableOperations.(SnapshotOperations)
+	if !ok {
+		return nil, errSnapshotsUnsupported
+	}
+	ctx, end := o.begin(ctx, "list_tables", attrProject.String(projectID), attrDataset.String(datasetID))
+	tables, err := ops.ListTables(ctx, projectID, datasetID, prefix)
+	end(err)
+	return tables, err
+}
+
+// ViewTarget reads the view if the wrapped table operations implement ViewOperations.
+func (o *instrumentedOperations) ViewTarget(ctx context.Context, view *bigquery.Table) (*bigquery.Table, error) {
+	ops, ok := o.TableOperations.(ViewOperations)
+	if !ok {
+		return nil, errViewsUnsupported
+	}
+	ctx, end := o.begin(ctx, "view_target", tableAttributes(view)...)
+	target, err := ops.ViewTarget(ctx, view)
+	end(err)
+	return target, err
+}
+
+// PointView points the view if the wrapped table operations implement ViewOperations.
+func (o *instrumentedOperations) PointView(ctx context.Context, view, target *bigquery.Table) error {
+	ops, ok := o.TableOperations.(ViewOperations)
+	if !ok {
+		return errViewsUnsupported
+	}
+	ctx, end := o.begin(ctx, "point_view", tableAttributes(view)...)
+	err := ops.PointView(ctx, view, target)
+	end(err)
+	return err
+}
+
+// ExpireTable expires the table if the wrapped table operations implement ViewOperations.
+func (o *instrumentedOperations) ExpireTable(ctx context.Context, table *bigquery.Table, expiration time.Time) error {
+	ops, ok := o.TableOperations.(ViewOperations)
+	if !ok {
+		return errViewsUnsupported
+	}
+	ctx, end := o.begin(ctx, "expire_table", tableAttributes(table)...)
+	err := ops.ExpireTable(ctx, table, expiration)
+	end(err)
+	return err
+}
+
+// insertSize estimates the size of the rows when JSON encoded, as sent by streaming inserts. The values returned by
+// Save are measured rather than encoded, counting numbers and temporal values at a fixed size.
+func insertSize(rows []bigquery.ValueSaver) int {
+	n := 0
+	for _, r := range rows {
+		row, insertID, err := r.Save()
+		if err != nil {
+			continue
+		}
+		n += valueSize(map[string]bigquery.Value(row)) + len(insertID)
+	}
+	return n
+}
+
+func valueSize(v bigquery.Value) int {
+	switch v := v.(type) {
+	case nil:
+		return 4
+	case bool:
+		return 5
+	case string:
+		return len(v) + 2
+	case []byte:
+		return (len(v)+2)/3*4 + 2
+	case map[string]bigquery.Value:
+		n := 2
+		for k, e := range v {
+			n += len(k) + 4 + valueSize(e)
+		}
+		return n
+	case []bigquery.Value:
+		n := 2
+		for _, e := range v {
+			n += valueSize(e) + 1
+		}
+		return n
+	case time.Time:
+		return 28
+	}
+	return 8
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
@@ -0,0 +1,48 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/api/googleapi"
+	"testing"
+)
+
+func Test_errorClass(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{context.Canceled, "canceled"},
+		{fmt.Errorf("while flushing: %w", context.DeadlineExceeded), "timeout"},
+		{&googleapi.Error{Code: 404}, "not_found"},
+		{&googleapi.Error{Code: 403, Message: "Exceeded rate limits"}, "rate_limit"},
+		{&googleapi.Error{Code: 403, Message: "Access denied"}, "permission"},
+		{&googleapi.Error{Code: 503}, "server"},
+		{errors.New("boom"), "other"},
+	}
+	for _, tt := range tests {
+		if got := errorClass(tt.err); got != tt.want {
+			t.Errorf("errorClass(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func Test_stepName(t *testing.T) {
+	if got := stepName("while writing to temporary table"); got != "writing_to_temporary_table" {
+		t.Errorf("unexpected step name %s", got)
+	}
+}
+
+func Test_insertSize(t *testing.T) {
+	rows := []bigquery.ValueSaver{
+		&savedRow{row: map[string]bigquery.Value{"s": "abc", "i": 1, "r": map[string]bigquery.Value{"b": true}}},
+		&savedRow{row: map[string]bigquery.Value{"l": []bigquery.Value{"a", nil}}},
+	}
+	// The encodings {"s":"abc","i":1,"r":{"b":true}} and {"l":["a",null]} are estimated with a separator after every
+	// entry and with numbers at a fixed size of 8.
+	if got := insertSize(rows); got != 42+18 {
+		t.Errorf("unexpected size, got %d", got)
+	}
+}
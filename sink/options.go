@@ -4,7 +4,9 @@ import (
 	"cloud.google.com/go/bigquery"
 	"context"
 	"github.com/3lvia/hn-config-lib-go/vault"
-	"github.com/3lvia/metrics-go/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/option"
 	"log"
 )
 
@@ -14,21 +16,84 @@ type optionsCollector struct {
 	ops       TableOperations
 	errorChan chan error
 
+	clientOptions []option.ClientOption
+
+	errorHandler func(e *ErrorEvent)
+	errorQueue   ErrorQueueOptions
+
+	datasetOps      DatasetOperations
+	datasetCreation *DatasetOptions
+	kmsKeyName      string
+	ledger          *ledgerOptions
+	lease           *LeaseOptions
+
 	v vault.SecretsManager
 
-	metrics metrics.Metrics
+	metrics Metrics
+
+	tracerProvider trace.TracerProvider
+	logger         Logger
+}
+
+// tracer returns the tracer of the tracer provider set with WithTracerProvider, or of the global provider if not set.
+func (c *optionsCollector) tracer() trace.Tracer {
+	tp := c.tracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
 }
 
-func (c *optionsCollector) operations(ctx context.Context) TableOperations {
+func (c *optionsCollector) operations(ctx context.Context, projects []string) TableOperations {
 	if c.ops != nil {
 		return c.ops
 	}
 
-	client, err := bigquery.NewClient(ctx, c.projectID)
-	if err != nil {
-		log.Fatal(err)
+	ops := &tableOperations{
+		defaultProject: c.projectID,
+		clients:        map[string]*bigquery.Client{},
+	}
+	for _, project := range append([]string{c.projectID}, projects...) {
+		if _, ok := ops.clients[project]; ok {
+			continue
+		}
+		client, err := bigquery.NewClient(ctx, project, c.clientOptions...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ops.clients[project] = client
+	}
+	return ops
+}
+
+// datasetOperations returns the dataset operations set with WithDatasetOperations. If not set, the table operations
+// are used if they also implement DatasetOperations. Nil is returned if no dataset operations are available.
+func (c *optionsCollector) datasetOperations(ops TableOperations) DatasetOperations {
+	if c.datasetOps != nil {
+		return c.datasetOps
+	}
+	if dops, ok := ops.(DatasetOperations); ok {
+		return dops
+	}
+	return nil
+}
+
+// deliver passes the error event on to the logger, the error handler and the error channel.
+func (c *optionsCollector) deliver(e *ErrorEvent) {
+	c.logger.Error("stream error",
+		"stream", e.Stream,
+		"iteration_id", e.IterationID,
+		"step", e.Step,
+		"table", e.Table,
+		"rows", e.Rows,
+		"retryable", e.Retryable,
+		"error", e.Error())
+	if c.errorHandler != nil {
+		c.errorHandler(e)
+	}
+	if c.errorChan != nil {
+		c.errorChan <- e
 	}
-	return &tableOperations{client: client}
 }
 
 // Option for configuring this package.
@@ -42,13 +107,63 @@ func WithBigQuery(projectID, datasetID string) Option {
 	}
 }
 
-// WithMetrics initializes this package with the metrics service.
-func WithMetrics(m metrics.Metrics) Option {
+// WithClientOptions sets options used when creating the BigQuery clients, for instance option.WithEndpoint to run
+// against the BigQuery emulator in tests.
+func WithClientOptions(opts ...option.ClientOption) Option {
+	return func(collector *optionsCollector) {
+		collector.clientOptions = append(collector.clientOptions, opts...)
+	}
+}
+
+// WithDatasetCreation makes this package create the datasets that the registered streams write to if they do not
+// already exist. Without this option, Start fails if a dataset is missing.
+func WithDatasetCreation(opts DatasetOptions) Option {
+	return func(collector *optionsCollector) {
+		collector.datasetCreation = &opts
+	}
+}
+
+// WithKMSKeyName sets the Cloud KMS key that all tables created by this package are encrypted with. Streams may
+// override the key by setting KMSKeyName in their schema. Existing tables are verified to use the expected key before
+// they are written to.
+func WithKMSKeyName(keyName string) Option {
+	return func(collector *optionsCollector) {
+		collector.kmsKeyName = keyName
+	}
+}
+
+// WithIterationLedger makes this package record the outcome of every iteration in a ledger table with the given name,
+// created in the dataset of each stream. When a producer sets the ID of an iteration that the ledger has already
+// recorded as committed, the policy decides whether the iteration is skipped or written again.
+func WithIterationLedger(table string, policy LedgerPolicy) Option {
+	return func(collector *optionsCollector) {
+		collector.ledger = &ledgerOptions{table: table, policy: policy}
+	}
+}
+
+// WithMetrics sets the metrics implementation that this package records metrics with. Use MetricsGo, PrometheusMetrics
+// or OpenTelemetryMetrics to adapt an existing metrics setup. If not set, no metrics are recorded.
+func WithMetrics(m Metrics) Option {
 	return func(collector *optionsCollector) {
 		collector.metrics = m
 	}
 }
 
+// WithTracerProvider sets the OpenTelemetry tracer provider used to trace flushes, completions and the operations
+// against BigQuery. If not set, the global tracer provider is used, which does nothing unless configured.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(collector *optionsCollector) {
+		collector.tracerProvider = tp
+	}
+}
+
+// WithLogger sets the logger that this package logs through. If not set, nothing is logged.
+func WithLogger(l Logger) Option {
+	return func(collector *optionsCollector) {
+		collector.logger = l
+	}
+}
+
 // WithTableOperations sets the interface that is used to write to BigQuery internally. The point is to provide a way
 // by which this package can be unit tested. This function should not be used in production.
 func WithTableOperations(op TableOperations) Option {
@@ -57,13 +172,40 @@ func WithTableOperations(op TableOperations) Option {
 	}
 }
 
-// WithErrorChannel sets a channel that this module will use to communicate all errors out.
+// WithDatasetOperations sets the interface that is used to verify and create datasets. As with WithTableOperations,
+// the point is to provide a way by which this package can be unit tested.
+func WithDatasetOperations(op DatasetOperations) Option {
+	return func(collector *optionsCollector) {
+		collector.datasetOps = op
+	}
+}
+
+// WithErrorChannel sets a channel that this module will use to communicate all errors out. The errors are of type
+// *ErrorEvent. Events wait in a bounded queue until they are received, see WithErrorQueue, so that a channel that is not
+// read does not stall the streams.
 func WithErrorChannel(errChan chan error) Option {
 	return func(collector *optionsCollector) {
 		collector.errorChan = errChan
 	}
 }
 
+// WithErrorHandler sets a callback that is called with every error event. The callback is called from a single
+// goroutine in the order the events occurred, and before the event is sent on the error channel, if any. Events wait
+// in a bounded queue while the callback runs, see WithErrorQueue.
+func WithErrorHandler(fn func(e *ErrorEvent)) Option {
+	return func(collector *optionsCollector) {
+		collector.errorHandler = fn
+	}
+}
+
+// WithErrorQueue configures the size of the queue that error events wait in until delivered, and which events are
+// dropped when it is full.
+func WithErrorQueue(opts ErrorQueueOptions) Option {
+	return func(collector *optionsCollector) {
+		collector.errorQueue = opts
+	}
+}
+
 // WithVault sets the vault secrets manager to be used. This is used for obtaining the Google Cloud service account that
 // must be set in order to access BigQuery. If this option is not used, this module will assume that the environment
 // variable GOOGLE_APPLICATION_CREDENTIALS has already been set by the client code.
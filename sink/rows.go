@@ -0,0 +1,54 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// savedRow holds the result of calling Save on a row received from a producer, so that the row is only saved once
+// when the handler needs to inspect its values.
+type savedRow struct {
+	row      map[string]bigquery.Value
+	insertID string
+}
+
+func (r *savedRow) Save() (map[string]bigquery.Value, string, error) {
+	return r.row, r.insertID, nil
+}
+
+func save(v bigquery.ValueSaver) (*savedRow, error) {
+	if r, ok := v.(*savedRow); ok {
+		return r, nil
+	}
+	row, insertID, err := v.Save()
+	if err != nil {
+		return nil, err
+	}
+	return &savedRow{row: row, insertID: insertID}, nil
+}
+
+// insertID derives a deterministic insertID from the iteration ID and the values of the given key columns.
+func insertID(iterationID string, row map[string]bigquery.Value, keys []string) (string, error) {
+	values := []interface{}{iterationID}
+	for _, key := range keys {
+		values = append(values, row[key])
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// newIterationID generates an ID for an iteration that was not given one by the producer.
+func newIterationID() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405"), hex.EncodeToString(b))
+}
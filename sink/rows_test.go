@@ -0,0 +1,33 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"testing"
+	"time"
+)
+
+func Test_insertID(t *testing.T) {
+	ts := time.Date(2026, 10, 17, 9, 16, 1, 1, time.UTC)
+	row := map[string]bigquery.Value{"meter": "m1", "ts": ts, "value": 1.5}
+	same := map[string]bigquery.Value{"meter": "m1", "ts": ts, "value": 2.5}
+	other := map[string]bigquery.Value{"meter": "m2", "ts": ts, "value": 1.5}
+	keys := []string{"meter", "ts"}
+
+	id := func(iteration string, r map[string]bigquery.Value) string {
+		got, err := insertID(iteration, r, keys)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return got
+	}
+
+	if id("it1", row) != id("it1", same) {
+		t.Error("expected equal insertIDs for equal keys")
+	}
+	if id("it1", row) == id("it1", other) {
+		t.Error("expected different insertIDs for different keys")
+	}
+	if id("it1", row) == id("it2", row) {
+		t.Error("expected different insertIDs for different iterations")
+	}
+}
@@ -12,8 +12,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"github.com/3lvia/metrics-go/metrics"
 	"log"
+	"sync"
 )
 
 var streams []*streamImpl
@@ -26,7 +26,7 @@ func Start(ctx context.Context, opts ...Option) {
 		log.Fatal(err)
 	}
 
-	collector := &optionsCollector{}
+	collector := &optionsCollector{logger: nopLogger{}, metrics: nopMetrics{}}
 	for _, opt := range opts {
 		opt(collector)
 	}
@@ -36,45 +36,117 @@ func Start(ctx context.Context, opts ...Option) {
 		log.Fatal(err)
 	}
 
-	errorChan := make(chan error)
-	externalErrChan := collector.errorChan
-
-	ops := collector.operations(ctx)
+	errorChan := make(chan *ErrorEvent)
 
+	var pending []*streamImpl
+	var projects []string
 	for _, stream := range streams {
+		if stream.started {
+			continue
+		}
+		if stream.schema.ProjectID == "" {
+			stream.schema.ProjectID = collector.projectID
+		}
+		if stream.schema.DatasetID == "" {
+			stream.schema.DatasetID = collector.datasetID
+		}
+		if stream.schema.KMSKeyName == "" {
+			stream.schema.KMSKeyName = collector.kmsKeyName
+		}
+		projects = append(projects, stream.schema.ProjectID)
+		pending = append(pending, stream)
+	}
+
+	ops := collector.operations(ctx, projects)
+
+	if dops := collector.datasetOperations(ops); dops != nil {
+		err = ensureDatasets(ctx, dops, pending, collector.datasetCreation)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	tracer := collector.tracer()
+	for _, stream := range pending {
+		obs := newObserver(stream.Type(), collector.metrics)
 		handler := &streamHandler{
-			dataset:    collector.datasetID,
-			operations: ops,
-			metrics:    collector.metrics,
+			dataset:    stream.schema.DatasetID,
+			operations: &instrumentedOperations{TableOperations: ops, observer: obs, tracer: tracer, health: stream.health},
+			observer:   obs,
+			tracer:     tracer,
+			logger:     collector.logger,
+			ledger:     collector.ledger,
+			lease:      collector.lease,
 		}
+		collector.logger.Info("starting stream",
+			"stream", stream.Type(),
+			"project", stream.schema.ProjectID,
+			"dataset", stream.schema.DatasetID,
+			"table", stream.schema.BQSchema.Name,
+			"disposition", string(stream.schema.Disposition))
+		stream.started = true
+		stream.health.started()
 		go handler.start(ctx, stream, errorChan)
 	}
 
-	go func(ec <-chan error, ext chan<- error) {
-		for {
-			e := <-ec
-			collector.metrics.IncCounter("sink_errors", metrics.DayLabels())
-			log.Print(fmt.Sprintf("%v", e))
-			if ext != nil {
-				ext <- e
-			}
+	queue := newErrorQueue(collector.errorQueue, collector.metrics)
+	go func(ec <-chan *ErrorEvent) {
+		for e := range ec {
+			queue.publish(e)
 		}
-	}(errorChan, externalErrChan)
+	}(errorChan)
+	go queue.dispatch(collector.deliver)
 
 }
 
 // Stream creates and returns a streamImpl that client code chan be used to streamImpl objects that shall be written to
 // BigQuery. This function has the side effect of caching the corresponding target streamImpl internally so that changes
 // are handled when this package is started.
-func Stream(typ string, schema Schema) SourceStream {
+func Stream(typ string, schema Schema, opts ...StreamOption) SourceStream {
+	collector := &streamOptionsCollector{}
+	for _, opt := range opts {
+		opt(collector)
+	}
 	s := &streamImpl{
-		typ:    typ,
-		schema: schema,
-		object: make(chan bigquery.ValueSaver),
-		list:   make(chan []bigquery.ValueSaver),
-		flush:  make(chan struct{}),
-		done:   make(chan struct{}),
+		typ:       typ,
+		schema:    schema,
+		opts:      collector,
+		object:    make(chan bigquery.ValueSaver),
+		list:      make(chan []bigquery.ValueSaver),
+		flush:     make(chan struct{}),
+		done:      make(chan struct{}),
+		iteration: make(chan string),
+		errs:      make(chan error),
+		control:   make(chan func(s *streamHandler)),
+		commands:  make(chan iterationCommand),
+		mux:       &sync.Mutex{},
+		links:     newTraceLinks(),
+		health:    newHealthState(typ),
+	}
+	if collector.wal != nil {
+		w, err := openWAL(*collector.wal)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.wal = w
 	}
 	streams = append(streams, s)
 	return s
-}
\ No newline at end of file
+}
+
+// ensureDatasets verifies that each distinct dataset written to by the given streams exists, creating it if create is
+// not nil.
+func ensureDatasets(ctx context.Context, ops DatasetOperations, streams []*streamImpl, create *DatasetOptions) error {
+	seen := map[string]bool{}
+	for _, stream := range streams {
+		key := fmt.Sprintf("%s.%s", stream.schema.ProjectID, stream.schema.DatasetID)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if err := ops.EnsureDataset(ctx, stream.schema.ProjectID, stream.schema.DatasetID, create); err != nil {
+			return fmt.Errorf("while ensuring dataset %s: %w", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const metricsSnapshots = `sink_snapshots`
+
+// snapshotInfix separates the name of the table from the time the snapshot was taken in the names of snapshot tables.
+const snapshotInfix = "_snapshot_"
+
+const snapshotTimeLayout = "20060102_150405"
+
+// SnapshotOperations is the snapshot-capable extension of TableOperations, needed by streams with snapshots and by
+// Rollback. The table operations used by default implement it.
+type SnapshotOperations interface {
+	// Snapshot creates a snapshot of the source table. The snapshot expires at the given time, unless it is zero.
+	Snapshot(ctx context.Context, source, snapshot *bigquery.Table, expiration time.Time) error
+
+	// Restore replaces the content of the destination table with the content of the snapshot. If encryption is not
+	// nil, the destination is encrypted with the given customer-managed key.
+	Restore(ctx context.Context, snapshot, dest *bigquery.Table, encryption *bigquery.EncryptionConfig) error
+
+	// ListTables returns the tables in the dataset whose IDs start with the prefix.
+	ListTables(ctx context.Context, projectID, datasetID, prefix string) ([]*bigquery.Table, error)
+}
+
+// errSnapshotsUnsupported is returned when a stream has snapshots but the table operations cannot take them.
+var errSnapshotsUnsupported = errors.New("table operations do not implement SnapshotOperations")
+
+// SnapshotOptions configures the snapshots taken of the target table of a truncate stream.
+type SnapshotOptions struct {
+	// Retention is how long snapshots are kept before BigQuery deletes them. If zero, snapshots are kept until they are
+	// deleted by other means.
+	Retention time.Duration
+
+	// DatasetID is the dataset that snapshots are created in. If empty, the dataset of the stream is used.
+	DatasetID string
+}
+
+// WithSnapshots makes a truncate stream take a snapshot of the target table before it is replaced with the rows of an
+// iteration. Target tables without rows are not snapshotted. The snapshots of a stream are listed with Snapshots, and
+// a target table is restored from one of them with Rollback. Snapshots are not taken for streams using view swaps.
+func WithSnapshots(opts SnapshotOptions) StreamOption {
+	return func(collector *streamOptionsCollector) {
+		collector.snapshots = &opts
+	}
+}
+
+// Snapshot is a snapshot of the target table of a stream.
+type Snapshot struct {
+	// ID identifies the snapshot when calling Rollback. It is the ID of the snapshot table.
+	ID string
+
+	// Table is the table the snapshot was taken of.
+	Table string
+
+	// TakenAt is when the snapshot was taken.
+	TakenAt time.Time
+}
+
+// snapshotID returns the ID of a snapshot of the table taken at the given time.
+func snapshotID(table string, t time.Time) string {
+	return table + snapshotInfix + t.UTC().Format(snapshotTimeLayout)
+}
+
+// parseSnapshotID returns the snapshot with the given ID, or an error if the ID was not created by snapshotID.
+func parseSnapshotID(id string) (Snapshot, error) {
+	i := strings.LastIndex(id, snapshotInfix)
+	if i <= 0 {
+		return Snapshot{}, fmt.Errorf("invalid snapshot ID %q", id)
+	}
+	suffix := id[i+len(snapshotInfix):]
+	t, err := time.Parse(snapshotTimeLayout, suffix)
+	if err != nil || t.Format(snapshotTimeLayout) != suffix {
+		return Snapshot{}, fmt.Errorf("invalid snapshot ID %q", id)
+	}
+	return Snapshot{ID: id, Table: id[:i], TakenAt: t}, nil
+}
+
+// Snapshots returns the snapshots of the target tables of the started stream with the given type, oldest first. These
+// are the snapshots of the table named in the schema of the stream, and of the tables that the stream has routed rows
+// to and snapshotted since it was started.
+func Snapshots(ctx context.Context, streamType string) ([]Snapshot, error) {
+	var snapshots []Snapshot
+	err := control(ctx, streamType, func(s *streamHandler) error {
+		var err error
+		snapshots, err = s.snapshots(ctx)
+		return err
+	})
+	return snapshots, err
+}
+
+// Rollback replaces the content of the target table that the snapshot with the given ID was taken of with the content
+// of the snapshot. The snapshot must be one of those returned by Snapshots. The rollback runs between the flushes and completions of the stream, so it is not overwritten by an
+// iteration in progress, but the next iteration to complete replaces the target table as usual.
+func Rollback(ctx context.Context, streamType, snapshotID string) error {
+	return control(ctx, streamType, func(s *streamHandler) error {
+		return s.rollback(ctx, snapshotID)
+	})
+}
+
+// control runs fn in the handler of the started stream with the given type and returns its error.
+func control(ctx context.Context, streamType string, fn func(s *streamHandler) error) error {
+	var stream *streamImpl
+	for _, s := range streams {
+		if s.typ == streamType && s.started {
+			stream = s
+		}
+	}
+	if stream == nil {
+		return fmt.Errorf("no started stream of type %s", streamType)
+	}
+
+	result := make(chan error, 1)
+	select {
+	case stream.control <- func(s *streamHandler) { result <- fn(s) }:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// snapshotDataset returns the dataset that snapshots of the stream are created in.
+func (s *streamHandler) snapshotDataset() string {
+	if o := s.stream.opts.snapshots; o != nil && o.DatasetID != "" {
+		return o.DatasetID
+	}
+	return s.dataset
+}
+
+// snapshotRef returns a reference to the snapshot table with the given ID.
+func (s *streamHandler) snapshotRef(id string) *bigquery.Table {
+	return s.operations.TableRef(s.snapshotDataset(), Schema{
+		BQSchema:  &bigquery.TableMetadata{Name: id},
+		ProjectID: s.stream.schema.ProjectID,
+	})
+}
+
+// snapshot takes a snapshot of the target table, if the stream has snapshots and the table has rows.
+func (s *streamHandler) snapshot(ctx context.Context, table *bigquery.Table) error {
+	o := s.stream.opts.snapshots
+	if o == nil {
+		return nil
+	}
+	ops, ok := s.operations.(SnapshotOperations)
+	if !ok {
+		return errSnapshotsUnsupported
+	}
+
+	md, err := s.metadata(ctx, table)
+	if err != nil {
+		return err
+	}
+	if md.NumRows == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	var expiration time.Time
+	if o.Retention > 0 {
+		expiration = now.Add(o.Retention)
+	}
+	id := snapshotID(table.TableID, now)
+	if err := ops.Snapshot(ctx, table, s.snapshotRef(id), expiration); err != nil {
+		return err
+	}
+	if s.snapshotted == nil {
+		s.snapshotted = map[string]struct{}{}
+	}
+	s.snapshotted[table.TableID] = struct{}{}
+	s.observer.snapshotTaken()
+	s.logger.Debug("snapshot taken",
+		"stream", s.stream.Type(),
+		"table", table.TableID,
+		"snapshot_id", id)
+	return nil
+}
+
+// snapshotTables returns the target tables of the stream that snapshots are listed for: the table named in the schema
+// and the tables snapshotted since the stream was started.
+func (s *streamHandler) snapshotTables() map[string]struct{} {
+	tables := map[string]struct{}{s.stream.schema.BQSchema.Name: {}}
+	for t := range s.snapshotted {
+		tables[t] = struct{}{}
+	}
+	return tables
+}
+
+// snapshots lists the snapshots of the target tables of the stream.
+func (s *streamHandler) snapshots(ctx context.Context) ([]Snapshot, error) {
+	ops, ok := s.operations.(SnapshotOperations)
+	if !ok {
+		return nil, errSnapshotsUnsupported
+	}
+
+	var snapshots []Snapshot
+	for name := range s.snapshotTables() {
+		tables, err := ops.ListTables(ctx, s.stream.schema.ProjectID, s.snapshotDataset(), name+snapshotInfix)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tables {
+			// The prefix also matches the snapshots of tables such as readings_snapshot_x, which are skipped.
+			snapshot, err := parseSnapshotID(t.TableID)
+			if err != nil || snapshot.Table != name {
+				continue
+			}
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].TakenAt.Before(snapshots[j].TakenAt)
+	})
+	return snapshots, nil
+}
+
+// rollback restores the target table that the snapshot was taken of from the snapshot.
+func (s *streamHandler) rollback(ctx context.Context, id string) error {
+	snapshot, err := parseSnapshotID(id)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.snapshotTables()[snapshot.Table]; !ok {
+		return fmt.Errorf("snapshot %s is not of a target table of stream %s", id, s.stream.Type())
+	}
+	ops, ok := s.operations.(SnapshotOperations)
+	if !ok {
+		return errSnapshotsUnsupported
+	}
+
+	schema := s.stream.schema
+	schema.BQSchema = &bigquery.TableMetadata{Name: snapshot.Table}
+	table := s.operations.TableRef(s.dataset, schema)
+	if err := ops.Restore(ctx, s.snapshotRef(id), table, encryptionConfig(schema)); err != nil {
+		return fmt.Errorf("while restoring %s from snapshot %s: %w", snapshot.Table, id, err)
+	}
+	s.logger.Info("table restored from snapshot",
+		"stream", s.stream.Type(),
+		"table", snapshot.Table,
+		"snapshot_id", id)
+	return nil
+}
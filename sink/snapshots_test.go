@@ -0,0 +1,25 @@
+package sink
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_parseSnapshotID(t *testing.T) {
+	taken := time.Date(2021, 11, 3, 14, 5, 9, 0, time.UTC)
+	id := snapshotID("readings_snapshot_daily", taken)
+
+	snapshot, err := parseSnapshotID(id)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if snapshot.Table != "readings_snapshot_daily" || !snapshot.TakenAt.Equal(taken) {
+		t.Errorf("unexpected snapshot %+v", snapshot)
+	}
+
+	for _, invalid := range []string{"readings", "readings_snapshot_", "_snapshot_20211103_140509", "readings_snapshot_2021"} {
+		if _, err := parseSnapshotID(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// spooledRow is the on-disk representation of a row. The values are stored in the form BigQuery expects for the type
+// of their column, and decoded back into the Go types of their column with decodeSpooledRecord.
+type spooledRow struct {
+	InsertID string                     `json:"i,omitempty"`
+	Row      map[string]json.RawMessage `json:"r"`
+}
+
+// spool holds rows that have been spilled from memory to a compressed file of length-prefixed records.
+type spool struct {
+	file   *os.File
+	z      *flate.Writer
+	w      *bufio.Writer
+	rows   int
+	schema bigquery.Schema
+}
+
+func newSpool(dir string) (*spool, error) {
+	f, err := os.CreateTemp(dir, "sink-*.spool")
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	z, err := flate.NewWriter(w, flate.BestSpeed)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &spool{file: f, z: z, w: w}, nil
+}
+
+// append encodes the rows and appends them to the spool file.
+func (s *spool) append(schema bigquery.Schema, rows []bigquery.ValueSaver) error {
+	s.schema = schema
+	var prefix [binary.MaxVarintLen64]byte
+	for _, r := range rows {
+		b, err := encodeSpooled(schema, r)
+		if err != nil {
+			return err
+		}
+		n := binary.PutUvarint(prefix[:], uint64(len(b)))
+		if _, err := s.z.Write(prefix[:n]); err != nil {
+			return err
+		}
+		if _, err := s.z.Write(b); err != nil {
+			return err
+		}
+		s.rows++
+	}
+	return nil
+}
+
+// each reads the spooled rows back in chunks of at most size rows and calls fn for each chunk.
+func (s *spool) each(size int, fn func(rows []bigquery.ValueSaver) error) error {
+	if err := s.z.Close(); err != nil {
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(flate.NewReader(bufio.NewReader(s.file)))
+	chunk := make([]bigquery.ValueSaver, 0, size)
+	for i := 0; i < s.rows; i++ {
+		row, err := decodeSpooled(s.schema, r)
+		if err != nil {
+			return err
+		}
+		chunk = append(chunk, row)
+		if len(chunk) >= size {
+			if err := fn(chunk); err != nil {
+				return err
+			}
+			chunk = make([]bigquery.ValueSaver, 0, size)
+		}
+	}
+	if len(chunk) > 0 {
+		return fn(chunk)
+	}
+	return nil
+}
+
+// close releases the spool, removing the spool file.
+func (s *spool) close() error {
+	_ = s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+func encodeSpooled(schema bigquery.Schema, v bigquery.ValueSaver) ([]byte, error) {
+	row, insertID, err := v.Save()
+	if err != nil {
+		return nil, err
+	}
+	encoded := encodeRecord(schema, row)
+	sr := spooledRow{InsertID: insertID, Row: make(map[string]json.RawMessage, len(encoded))}
+	for k, v := range encoded {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		sr.Row[k] = b
+	}
+	return json.Marshal(sr)
+}
+
+func decodeSpooled(schema bigquery.Schema, r *bufio.Reader) (*savedRow, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return decodeSpooledRecord(schema, b)
+}
+
+// decodeSpooledRecord decodes a row encoded by encodeSpooled, converting the values back into the Go types that the
+// bigquery package uses for the types of their columns in the schema. Values that do not have the form of their
+// column, and values of columns that are not in the schema, are decoded as plain JSON values.
+func decodeSpooledRecord(schema bigquery.Schema, b []byte) (*savedRow, error) {
+	sr := spooledRow{}
+	if err := json.Unmarshal(b, &sr); err != nil {
+		return nil, err
+	}
+	fields := map[string]*bigquery.FieldSchema{}
+	for _, f := range schema {
+		fields[f.Name] = f
+	}
+	row := make(map[string]bigquery.Value, len(sr.Row))
+	for k, raw := range sr.Row {
+		v, err := decodeJSON(raw)
+		if err != nil {
+			return nil, err
+		}
+		if f, ok := fields[k]; ok {
+			v = decodeField(f, v)
+		}
+		row[k] = v
+	}
+	return &savedRow{row: row, insertID: sr.InsertID}, nil
+}
+
+// decodeJSON decodes the JSON value, keeping numbers as json.Number so that integers are not turned into floats.
+func decodeJSON(raw json.RawMessage) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func decodeField(f *bigquery.FieldSchema, v interface{}) bigquery.Value {
+	list, ok := v.([]interface{})
+	if !f.Repeated || !ok {
+		return decodeValue(f, v)
+	}
+	values := make([]bigquery.Value, len(list))
+	for i, e := range list {
+		values[i] = decodeValue(f, e)
+	}
+	return values
+}
+
+func decodeValue(f *bigquery.FieldSchema, v interface{}) bigquery.Value {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil && f.Type != bigquery.FloatFieldType {
+			return i
+		}
+		if fl, err := x.Float64(); err == nil {
+			return fl
+		}
+		return x.String()
+	case string:
+		return decodeString(f, x)
+	case map[string]interface{}:
+		if f.Type != bigquery.RecordFieldType {
+			return x
+		}
+		fields := map[string]*bigquery.FieldSchema{}
+		for _, sub := range f.Schema {
+			fields[sub.Name] = sub
+		}
+		m := make(map[string]bigquery.Value, len(x))
+		for k, e := range x {
+			if sub, ok := fields[k]; ok {
+				e = decodeField(sub, e)
+			}
+			m[k] = e
+		}
+		return m
+	}
+	return v
+}
+
+// decodeString converts a string encoded by encodeValue back into the Go type of the column.
+func decodeString(f *bigquery.FieldSchema, s string) bigquery.Value {
+	switch f.Type {
+	case bigquery.TimestampFieldType:
+		if t, err := time.Parse(spooledTimestampLayout, s); err == nil {
+			return t
+		}
+	case bigquery.DateFieldType:
+		if d, err := civil.ParseDate(s); err == nil {
+			return d
+		}
+	case bigquery.TimeFieldType:
+		if t, err := civil.ParseTime(s); err == nil {
+			return t
+		}
+	case bigquery.DateTimeFieldType:
+		if dt, err := civil.ParseDateTime(strings.Replace(s, " ", "T", 1)); err == nil {
+			return dt
+		}
+	case bigquery.NumericFieldType, bigquery.BigNumericFieldType:
+		if r, ok := new(big.Rat).SetString(s); ok {
+			return r
+		}
+	case bigquery.BytesFieldType:
+		if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+			return b
+		}
+	}
+	return s
+}
@@ -0,0 +1,105 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"fmt"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_spool(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "s", Type: bigquery.StringFieldType},
+		{Name: "ts", Type: bigquery.TimestampFieldType},
+	}
+	ts := time.Date(2026, 10, 17, 9, 16, 1, 0, time.UTC)
+
+	sp, err := newSpool(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer sp.close()
+
+	var rows []bigquery.ValueSaver
+	for i := 0; i < 5; i++ {
+		rows = append(rows, &savedRow{row: map[string]bigquery.Value{"s": fmt.Sprintf("%d", i), "ts": ts}, insertID: fmt.Sprintf("id%d", i)})
+	}
+	if err := sp.append(schema, rows); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var chunks []int
+	var got []bigquery.ValueSaver
+	err = sp.each(2, func(rows []bigquery.ValueSaver) error {
+		chunks = append(chunks, len(rows))
+		got = append(got, rows...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if fmt.Sprint(chunks) != "[2 2 1]" {
+		t.Errorf("unexpected chunks, got %v", chunks)
+	}
+
+	row, id, _ := got[4].Save()
+	if id != "id4" {
+		t.Errorf("unexpected insertID, got %s", id)
+	}
+	if want := map[string]bigquery.Value{"s": "4", "ts": ts}; !reflect.DeepEqual(row, want) {
+		t.Errorf("unexpected row, got %#v, want %#v", row, want)
+	}
+}
+
+func Test_decodeSpooledRecord(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "i", Type: bigquery.IntegerFieldType},
+		{Name: "f", Type: bigquery.FloatFieldType},
+		{Name: "b", Type: bigquery.BytesFieldType},
+		{Name: "ts", Type: bigquery.TimestampFieldType},
+		{Name: "d", Type: bigquery.DateFieldType},
+		{Name: "t", Type: bigquery.TimeFieldType},
+		{Name: "dt", Type: bigquery.DateTimeFieldType},
+		{Name: "n", Type: bigquery.NumericFieldType},
+		{Name: "tags", Type: bigquery.StringFieldType, Repeated: true},
+		{Name: "rec", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "d", Type: bigquery.DateFieldType},
+		}},
+	}
+	date := civil.Date{Year: 2026, Month: 10, Day: 17}
+	row := map[string]bigquery.Value{
+		"i":     int64(42),
+		"f":     float64(2),
+		"b":     []byte{0, 1, 2},
+		"ts":    time.Date(2026, 10, 17, 9, 16, 1, 500000000, time.UTC),
+		"d":     date,
+		"t":     civil.Time{Hour: 9, Minute: 16},
+		"dt":    civil.DateTime{Date: date, Time: civil.Time{Hour: 9}},
+		"n":     big.NewRat(12345, 100),
+		"tags":  []bigquery.Value{"a", "b"},
+		"rec":   map[string]bigquery.Value{"d": date},
+		"extra": "x",
+	}
+	b, err := encodeSpooled(schema, &savedRow{row: row})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	got, err := decodeSpooledRecord(schema, b)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if n, ok := got.row["n"].(*big.Rat); !ok || n.Cmp(row["n"].(*big.Rat)) != 0 {
+		t.Errorf("unexpected numeric, got %#v", got.row["n"])
+	}
+	delete(got.row, "n")
+	delete(row, "n")
+	if !reflect.DeepEqual(got.row, row) {
+		t.Errorf("unexpected row, got %#v, want %#v", got.row, row)
+	}
+	if err := Validate(schema, got.row); err == nil || len(err.(*ValidationError).Errors) != 1 {
+		t.Errorf("expected only the unknown column to fail validation, got %v", err)
+	}
+}
@@ -3,94 +3,550 @@ package sink
 import (
 	"cloud.google.com/go/bigquery"
 	"context"
-	"fmt"
-	"github.com/3lvia/metrics-go/metrics"
-	"github.com/pkg/errors"
-	"log"
+	"errors"
+	"go.opentelemetry.io/otel/trace"
+	"sort"
 	"time"
 )
 
-const (
-	metricsTemplateReceived = `sink_%s_received`
-	metricsTemplateFlushed = `sink_%s_flushed`
-	metricsErrors = `sink_errors`
-)
+type writeOrchestration func(ctx context.Context, d *destination, done bool) (string, error)
+
+// destination holds the rows buffered for a single target table together with the state of the current iteration
+// against that table.
+type destination struct {
+	schema            Schema
+	rows              []bigquery.ValueSaver
+	tempTable         *bigquery.Table
+	tempCreated       time.Time
+	load              *loadBuffer
+	spool             *spool
+	written           int
+	previouslyFlushed bool
+}
 
-type writeOrchestration func(ctx context.Context, rows []bigquery.ValueSaver, stream *streamImpl, previouslyFlushed, done bool) (string, error)
+// count returns the number of rows buffered for the destination, in memory and spooled.
+func (d *destination) count() int {
+	n := len(d.rows)
+	if d.spool != nil {
+		n += d.spool.rows
+	}
+	return n
+}
+
+// each calls fn for each chunk of rows buffered for the destination, first those read back from the spool and then
+// those held in memory. fn is always called at least once, with the rows held in memory.
+func (d *destination) each(chunk int, fn func(rows []bigquery.ValueSaver) error) error {
+	if d.spool != nil {
+		err := d.spool.each(chunk, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return fn(d.rows)
+}
+
+// reset discards the rows buffered for the destination.
+func (d *destination) reset() {
+	d.rows = []bigquery.ValueSaver{}
+	if d.spool != nil {
+		_ = d.spool.close()
+		d.spool = nil
+	}
+}
 
 type streamHandler struct {
-	dataset    string
-	operations TableOperations
-	tempTable  *bigquery.Table
-	metrics    metrics.Metrics
+	stream       *streamImpl
+	dataset      string
+	operations   TableOperations
+	observer     *observer
+	tracer       trace.Tracer
+	logger       Logger
+	destinations map[string]*destination
+	ledger       *ledgerOptions
+	lease        *LeaseOptions
+
+	iterationID    string
+	iterationStart time.Time
+	iterationRows  int
+	skip           bool
+	seen           map[string]struct{}
+	walSeq         uint64
+	walHeld        bool
+	walHold        uint64
+	pending        int
+	ledgerRef      *bigquery.Table
+	ledgerStatus   map[string]string
+	deadLetters    []bigquery.ValueSaver
+	deadLetterRef  *bigquery.Table
+	snapshotted    map[string]struct{}
 }
 
-func (s *streamHandler) start(ctx context.Context, stream *streamImpl, errorOutput chan<- error) {
-	metricsReceived := fmt.Sprintf(metricsTemplateReceived, stream.Type())
-	metricsFlushed := fmt.Sprintf(metricsTemplateFlushed, stream.Type())
+func (s *streamHandler) start(ctx context.Context, stream *streamImpl, errorOutput chan<- *ErrorEvent) {
+	s.stream = stream
+	o := s.orchestration(stream.schema)
+	s.destinations = map[string]*destination{}
 
-	o := s.orchestration(stream.schema.Disposition)
-	previouslyFlushed := false
+	s.replay(ctx, o, stream, errorOutput)
 
-	var rows []bigquery.ValueSaver
 	for {
 		select {
 		case obj := <-stream.object:
-			rows = append(rows, obj)
-			s.metrics.IncCounter(metricsReceived, metrics.DayLabels())
+			s.receive(obj, stream, errorOutput)
 		case objs := <-stream.list:
 			for _, obj := range objs {
-				rows = append(rows, obj)
-				s.metrics.IncCounter(metricsReceived, metrics.DayLabels())
+				s.receive(obj, stream, errorOutput)
 			}
 		case <-stream.flush:
-			s.flush(ctx, o, rows, stream, previouslyFlushed, false, errorOutput, metricsFlushed)
-			rows = []bigquery.ValueSaver{}
-			previouslyFlushed = true
+			_ = s.command(ctx, o, stream, commandFlush, errorOutput)
 		case <-stream.done:
-			s.flush(ctx, o, rows, stream, previouslyFlushed, true, errorOutput, metricsFlushed)
-			rows = []bigquery.ValueSaver{}
-			previouslyFlushed = false
+			_ = s.command(ctx, o, stream, commandComplete, errorOutput)
+		case cmd := <-stream.commands:
+			cmd.reply <- s.command(ctx, o, stream, cmd.op, errorOutput)
+		case id := <-stream.iteration:
+			s.setIteration(ctx, id, errorOutput)
+		case err := <-stream.errs:
+			s.reportErr(err, "while appending to write-ahead log", errorOutput)
+		case fn := <-stream.control:
+			fn(s)
 		}
 	}
 }
 
+// command runs the command against the current iteration, committing the write-ahead log if it succeeds. The error
+// of a failed write is returned after being reported.
+func (s *streamHandler) command(ctx context.Context, o writeOrchestration, stream *streamImpl, op iterationCommandOp, errorOutput chan<- *ErrorEvent) error {
+	switch op {
+	case commandFlush:
+		err := s.flush(ctx, o, stream, false, errorOutput)
+		if err != nil {
+			s.hold(stream)
+		} else if stream.schema.Disposition == bigquery.WriteAppend {
+			s.commit(s.walSeq, errorOutput)
+		}
+		return err
+	case commandComplete:
+		err := s.complete(ctx, o, stream, errorOutput)
+		if err != nil {
+			s.hold(stream)
+		} else if stream.wal != nil {
+			s.commit(stream.wal.completed(), errorOutput)
+		}
+		return err
+	case commandAbort:
+		return s.abort(ctx, stream, errorOutput)
+	}
+	return nil
+}
+
+// complete completes the current iteration, writing the buffered rows and recording the outcome in the ledger. An
+// iteration that has already been committed according to the ledger is discarded. The error of a failed write is
+// returned.
+func (s *streamHandler) complete(ctx context.Context, o writeOrchestration, stream *streamImpl, errorOutput chan<- *ErrorEvent) error {
+	defer s.endIteration()
+
+	if s.iterationID == "" {
+		s.beginIteration(newIterationID())
+	}
+
+	if s.skip {
+		s.logger.Info("skipping iteration since it has already been committed",
+			"stream", stream.Type(),
+			"iteration_id", s.iterationID)
+		s.recordIteration(ctx, IterationSkipped, errorOutput)
+		return nil
+	}
+
+	err := s.flush(ctx, o, stream, true, errorOutput)
+	status := IterationCommitted
+	if err != nil {
+		status = IterationFailed
+	}
+	s.recordIteration(ctx, status, errorOutput)
+	return err
+}
+
+// setIteration sets the ID of the current iteration as given by the producer. If the ledger policy is to skip
+// iterations that have already been committed, the ledger is consulted.
+func (s *streamHandler) setIteration(ctx context.Context, id string, errorOutput chan<- *ErrorEvent) {
+	s.beginIteration(id)
+	if s.ledger == nil || s.ledger.policy != LedgerSkip {
+		return
+	}
+	committed, err := s.committed(ctx, id)
+	if err != nil {
+		s.reportErr(err, "while reading iteration ledger", errorOutput)
+		return
+	}
+	s.skip = committed
+}
+
+func (s *streamHandler) recordIteration(ctx context.Context, status string, errorOutput chan<- *ErrorEvent) {
+	if s.ledger == nil {
+		return
+	}
+	err := s.record(ctx, status)
+	if err != nil {
+		s.reportErr(err, "while recording iteration in ledger", errorOutput)
+	}
+}
+
+// beginIteration sets the ID of the current iteration, and its start time if not already set.
+func (s *streamHandler) beginIteration(id string) {
+	s.iterationID = id
+	if s.iterationStart.IsZero() {
+		s.iterationStart = time.Now().UTC()
+	}
+}
+
+// endIteration resets the state of the current iteration.
+func (s *streamHandler) endIteration() {
+	s.destinations = map[string]*destination{}
+	s.iterationID = ""
+	s.iterationStart = time.Time{}
+	s.iterationRows = 0
+	s.skip = false
+	s.seen = nil
+}
+
+// replay writes the rows that were left uncommitted in the write-ahead log of the stream by a previous run. Completed
+// iterations are replayed as such. Rows after the last completion marker are flushed for append streams and discarded
+// for truncate streams.
+func (s *streamHandler) replay(ctx context.Context, o writeOrchestration, stream *streamImpl, errorOutput chan<- *ErrorEvent) {
+	if stream.wal == nil {
+		return
+	}
+
+	var pending []bigquery.ValueSaver
+	var last uint64
+	err := stream.wal.replay(func(kind byte, seq uint64, data []byte) error {
+		last = seq
+		if kind == walKindRow {
+			row, err := decodeSpooledRecord(stream.schema.BQSchema.Schema, data)
+			if err != nil {
+				return err
+			}
+			pending = append(pending, &walEntry{savedRow: row, seq: seq})
+			return nil
+		}
+		for _, obj := range pending {
+			s.receive(obj, stream, errorOutput)
+		}
+		pending = nil
+		if s.complete(ctx, o, stream, errorOutput) != nil {
+			s.hold(stream)
+			return nil
+		}
+		s.commit(seq, errorOutput)
+		return nil
+	})
+	if err != nil {
+		s.reportErr(err, "while replaying write-ahead log", errorOutput)
+	}
+
+	if len(pending) == 0 {
+		return
+	}
+	if stream.schema.Disposition != bigquery.WriteAppend {
+		s.logger.Warn("discarding incomplete iteration from write-ahead log",
+			"stream", stream.Type(),
+			"rows", len(pending))
+		s.commit(last, errorOutput)
+		return
+	}
+	for _, obj := range pending {
+		s.receive(obj, stream, errorOutput)
+	}
+	if s.flush(ctx, o, stream, false, errorOutput) != nil {
+		s.hold(stream)
+		return
+	}
+	s.commit(last, errorOutput)
+}
+
+// commit marks the records of the write-ahead log up to and including the given sequence number as written. The log
+// is not committed past a hold.
+func (s *streamHandler) commit(upTo uint64, errorOutput chan<- *ErrorEvent) {
+	if s.stream.wal == nil {
+		return
+	}
+	if s.walHeld && upTo > s.walHold {
+		upTo = s.walHold
+	}
+	if upTo == 0 {
+		return
+	}
+	err := s.stream.wal.commit(upTo)
+	if err != nil {
+		s.reportErr(err, "while committing write-ahead log", errorOutput)
+	}
+}
+
+// hold keeps the write-ahead log of an append stream from being committed past the rows of a failed write, which are
+// no longer buffered. The log is held at the records committed so far for the rest of the run, so that the rows are
+// replayed when the stream is started again, along with the rows written after them. Truncate streams are not held,
+// since a later completion replaces the rows of the failed iteration.
+func (s *streamHandler) hold(stream *streamImpl) {
+	if stream.wal == nil || s.walHeld || stream.schema.Disposition != bigquery.WriteAppend {
+		return
+	}
+	s.walHeld = true
+	s.walHold = stream.wal.committedSeq()
+	s.logger.Warn("holding write-ahead log after failed write",
+		"stream", stream.Type(),
+		"committed", s.walHold)
+}
+
+func (s *streamHandler) receive(obj bigquery.ValueSaver, stream *streamImpl, errorOutput chan<- *ErrorEvent) {
+	s.observer.received()
+
+	if s.iterationID == "" {
+		s.beginIteration(newIterationID())
+	}
+
+	if e, ok := obj.(*walEntry); ok {
+		s.walSeq = e.seq
+		obj = e.savedRow
+	}
+
+	if s.skip {
+		return
+	}
+
+	if !stream.opts.saveRows() {
+		s.buffer(obj, stream.schema.BQSchema.Name, errorOutput)
+		return
+	}
+	row, err := save(obj)
+	if err != nil {
+		e := s.event(err, "while saving row")
+		e.Rows = 1
+		s.report(e, errorOutput)
+		return
+	}
+	rows := []*savedRow{row}
+	if len(stream.opts.transformers) > 0 {
+		var ok bool
+		rows, ok = s.transform(row, errorOutput)
+		if !ok {
+			return
+		}
+	}
+	for _, row := range rows {
+		s.receiveRow(row, errorOutput)
+	}
+}
+
+// receiveRow coerces, validates, deduplicates and routes a saved row as configured for the stream, and buffers it.
+func (s *streamHandler) receiveRow(row *savedRow, errorOutput chan<- *ErrorEvent) {
+	stream := s.stream
+	opts := stream.opts
+	table := stream.schema.BQSchema.Name
+	if opts.coercion != nil {
+		coerced, err := Coerce(stream.schema.BQSchema.Schema, row.row, *opts.coercion)
+		if err != nil {
+			s.reject(row.row, err, "while coercing row", errorOutput)
+			return
+		}
+		row.row = coerced
+	}
+	if opts.validation != nil && !s.validate(row.row, errorOutput) {
+		return
+	}
+	var err error
+	if len(opts.insertIDKeys) > 0 {
+		row.insertID, err = insertID(s.iterationID, row.row, opts.insertIDKeys)
+		if err != nil {
+			e := s.event(err, "while deriving insertID")
+			e.Rows = 1
+			s.report(e, errorOutput)
+			return
+		}
+	}
+	if opts.deduplicate && s.duplicate(row.insertID) {
+		s.observer.duplicate()
+		return
+	}
+	if opts.router != nil {
+		table, err = opts.router(row.row)
+		if err != nil {
+			e := s.event(err, "while routing row")
+			e.Rows = 1
+			s.report(e, errorOutput)
+			return
+		}
+	}
+	s.buffer(row, table, errorOutput)
+}
+
+// buffer appends the row to the buffer of the destination table, spilling the buffer to its spool file when full.
+func (s *streamHandler) buffer(obj bigquery.ValueSaver, table string, errorOutput chan<- *ErrorEvent) {
+	stream := s.stream
+	opts := stream.opts
+	d := s.destination(table, stream.schema)
+	d.rows = append(d.rows, obj)
+	s.iterationRows++
+	s.pending++
+	s.observer.buffered(s.pending)
+	stream.health.buffered(s.pending)
+
+	if opts.spoolAfter > 0 && len(d.rows) >= opts.spoolAfter {
+		err := s.spill(d)
+		if err != nil {
+			e := s.event(err, "while spilling rows to spool")
+			e.Table = table
+			e.Rows = len(d.rows)
+			s.report(e, errorOutput)
+		}
+	}
+}
+
+// spill moves the rows buffered in memory for the destination to its spool file.
+func (s *streamHandler) spill(d *destination) error {
+	if d.spool == nil {
+		sp, err := newSpool(s.stream.opts.spoolDir)
+		if err != nil {
+			return err
+		}
+		d.spool = sp
+	}
+	err := d.spool.append(d.schema.BQSchema.Schema, d.rows)
+	if err != nil {
+		return err
+	}
+	d.rows = []bigquery.ValueSaver{}
+	return nil
+}
+
+// duplicate returns true if the insertID has already been seen in the current iteration, and otherwise remembers it.
+func (s *streamHandler) duplicate(insertID string) bool {
+	if insertID == "" {
+		return false
+	}
+	if s.seen == nil {
+		s.seen = map[string]struct{}{}
+	}
+	if _, ok := s.seen[insertID]; ok {
+		return true
+	}
+	s.seen[insertID] = struct{}{}
+	return false
+}
+
+// destination returns the buffer for the given table, creating it from the schema template if it does not exist.
+func (s *streamHandler) destination(table string, template Schema) *destination {
+	if d, ok := s.destinations[table]; ok {
+		return d
+	}
+	schema := template
+	if table != template.BQSchema.Name {
+		md := *template.BQSchema
+		md.Name = table
+		schema.BQSchema = &md
+	}
+	d := &destination{schema: schema}
+	s.destinations[table] = d
+	return d
+}
+
 func (s *streamHandler) flush(
 	ctx context.Context,
 	o writeOrchestration,
-	rows []bigquery.ValueSaver,
 	stream *streamImpl,
-	previouslyFlushed bool,
 	done bool,
-	errorOutput chan<- error,
-	metricsFlushed string) {
-	op := "flush"
+	errorOutput chan<- *ErrorEvent) error {
+	op, step := "flush", StepFlushing
 	if done {
-		op = "done"
+		op, step = "done", StepCompleting
 	}
-	log.Print(fmt.Sprintf("iteration %s received from %s", op, stream.Type()))
+	defer stream.health.enter(step)()
+	started := time.Now()
+	defer s.observer.flushDone(op, started)
 
-	msg, err := o(ctx, rows, stream, previouslyFlushed, done)
-	if err != nil {
-		s.reportErr(err, msg, errorOutput)
+	name := "sink.flush"
+	if done {
+		name = "sink.complete"
 	}
+	ctx, span := s.tracer.Start(ctx, name,
+		trace.WithLinks(stream.links.drain()...),
+		trace.WithAttributes(
+			attrStream.String(stream.Type()),
+			attrIteration.String(s.iterationID),
+			attrRows.Int(s.pending)))
+	ctx, jobs := withJobIDs(ctx)
+	var failed error
+	defer func() {
+		span.SetAttributes(attrTables.Int(len(s.destinations)))
+		endSpan(span, failed)
+	}()
 
-	c := s.metrics.Counter(metricsFlushed, metrics.DayLabels())
-	c.Add(float64(len(rows)))
+	if err := s.writeDeadLetters(ctx); err != nil {
+		e := s.event(err, "while writing dead letters")
+		e.Rows = len(s.deadLetters)
+		s.report(e, errorOutput)
+	}
+
+	if len(s.destinations) == 0 && stream.opts.router == nil {
+		s.destination(stream.schema.BQSchema.Name, stream.schema)
+	}
+
+	var tables []string
+	for table := range s.destinations {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	ok := true
+	for _, table := range tables {
+		d := s.destinations[table]
+		msg, err := o(ctx, d, done)
+		if err != nil {
+			e := s.event(err, msg)
+			e.Table = table
+			e.Rows = d.count()
+			s.report(e, errorOutput)
+			ok = false
+			failed = e
+		}
+
+		s.observer.flushed(table, d.count())
+		s.logger.Debug("flushed rows to table",
+			"stream", stream.Type(),
+			"op", op,
+			"table", table,
+			"rows", d.count())
+
+		d.reset()
+		d.previouslyFlushed = !done
+	}
+	s.logger.Info("iteration "+op+" written",
+		"stream", stream.Type(),
+		"op", op,
+		"iteration_id", s.iterationID,
+		"rows", s.pending,
+		"tables", len(tables),
+		"duration", time.Since(started),
+		"job_ids", jobs.list(),
+		"ok", ok)
+	s.pending = 0
+	s.observer.buffered(0)
+	stream.health.buffered(0)
+	stream.health.flushed(ok)
+	return failed
 }
 
-func (s *streamHandler) writeTruncate(ctx context.Context, rows []bigquery.ValueSaver, stream *streamImpl, previouslyFlushed, done bool) (string, error) {
-	if !previouslyFlushed {
-		tempTableName := tempTable(stream.schema.BQSchema.Name, time.Now().UTC())
-		tempSchema := tempTableSchema(tempTableName, stream.schema)
+func (s *streamHandler) writeTruncate(ctx context.Context, d *destination, done bool) (string, error) {
+	if !d.previouslyFlushed {
+		tempTableName := tempTable(d.schema.BQSchema.Name, time.Now().UTC())
+		tempSchema := tempTableSchema(tempTableName, d.schema)
 		tt, err := s.operations.CreateTable(ctx, s.dataset, tempSchema)
-		s.tempTable = tt
+		d.tempTable = tt
+		d.tempCreated = time.Now()
 		if err != nil {
 			return "while creating temporary table", err
 		}
 	}
-	
-	err := s.operations.Write(ctx, s.tempTable, rows)
+
+	err := s.writeTemp(ctx, d)
 	if err != nil {
 		return "while writing to temporary table", err
 	}
@@ -98,53 +554,252 @@ func (s *streamHandler) writeTruncate(ctx context.Context, rows []bigquery.Value
 	if !done {
 		return "", nil
 	}
-	
-	table, err := s.operations.CreateTable(ctx, s.dataset, stream.schema)
+
+	ctx, fence, release, err := s.acquireLease(ctx, d.schema)
+	if err != nil {
+		return "while acquiring lease", err
+	}
+	defer release()
+
+	table, err := s.operations.CreateTable(ctx, s.dataset, d.schema)
 	if err != nil {
 		return "while creating table", err
 	}
-	
-	err = s.operations.CopyTable(ctx, s.tempTable, table)
+
+	err = s.checkEncryption(ctx, table, d.schema)
 	if err != nil {
-		return "while copying data from temp table", err
+		return "while verifying table encryption", err
 	}
-	
-	err = s.operations.DeleteTable(ctx, s.tempTable)
+
+	err = s.checkGuard(ctx, table, table, d.tempTable, d.written)
+	if err != nil {
+		return "while checking truncate guard", err
+	}
+
+	err = s.checkAssertions(ctx, d.tempTable)
+	if err != nil {
+		return "while checking assertions", err
+	}
+
+	err = s.snapshot(ctx, table)
+	if err != nil {
+		return "while taking snapshot of table", err
+	}
+
+	err = fence()
+	if err != nil {
+		return "while renewing lease", err
+	}
+
+	err = s.copyTable(ctx, d.tempTable, table, d.schema)
+	if err != nil {
+		return "while copying data from temp table", fenced(ctx, fence, err)
+	}
+
+	err = s.operations.DeleteTable(ctx, d.tempTable)
 	if err != nil {
 		return "while deleting temp table", err
 	}
+	s.observer.tempTableDeleted(d.tempCreated)
 
 	return "", nil
 }
 
-func (s *streamHandler) writeAppend(ctx context.Context, rows []bigquery.ValueSaver, stream *streamImpl, previouslyFlushed, done bool) (string, error) {
+// rejected returns true if the error rejects an iteration, being a *GuardError or an *AssertionError.
+func rejected(err error) bool {
+	var guardErr *GuardError
+	var assertionErr *AssertionError
+	return errors.As(err, &guardErr) || errors.As(err, &assertionErr)
+}
+
+// writeTemp writes the rows buffered for the destination to its temporary table, counting the rows written.
+func (s *streamHandler) writeTemp(ctx context.Context, d *destination) error {
+	return d.each(s.stream.opts.spoolAfter, func(rows []bigquery.ValueSaver) error {
+		err := s.operations.Write(ctx, d.tempTable, rows)
+		if err == nil {
+			d.written += len(rows)
+		}
+		return err
+	})
+}
+
+func (s *streamHandler) writeAppend(ctx context.Context, d *destination, done bool) (string, error) {
 	var table *bigquery.Table
 	var err error
 
-	if previouslyFlushed {
-		table = s.operations.TableRef(s.dataset, stream.schema)
+	if d.previouslyFlushed {
+		table = s.operations.TableRef(s.dataset, d.schema)
 	} else {
-		table, err = s.operations.CreateTable(ctx, s.dataset, stream.schema)
+		table, err = s.operations.CreateTable(ctx, s.dataset, d.schema)
 		if err != nil {
 			return "while creating table", err
 		}
+		err = s.checkEncryption(ctx, table, d.schema)
+		if err != nil {
+			return "while verifying table encryption", err
+		}
 	}
 
-	err = s.operations.Write(ctx, table, rows)
+	err = d.each(s.stream.opts.spoolAfter, func(rows []bigquery.ValueSaver) error {
+		return s.operations.Write(ctx, table, rows)
+	})
 	if err != nil {
 		return "while writing directly", err
 	}
 	return "", nil
 }
 
-func (s *streamHandler) orchestration(disposition bigquery.TableWriteDisposition) writeOrchestration {
-	if disposition == bigquery.WriteAppend {
+func (s *streamHandler) writeLoad(ctx context.Context, d *destination, done bool) (string, error) {
+	var err error
+	if d.load == nil {
+		d.load, err = newLoadBuffer(s.stream.opts.loadSpoolDir)
+		if err != nil {
+			return "while creating load buffer", err
+		}
+	}
+
+	disposition := bigquery.WriteTruncate
+	if d.schema.Disposition == bigquery.WriteAppend {
+		disposition = bigquery.WriteAppend
+	}
+	if disposition == bigquery.WriteAppend || done {
+		defer func() {
+			_ = d.load.close()
+			d.load = nil
+		}()
+	}
+
+	err = d.each(s.stream.opts.spoolAfter, func(rows []bigquery.ValueSaver) error {
+		return d.load.append(d.schema.BQSchema.Schema, rows)
+	})
+	if err != nil {
+		return "while serializing rows", err
+	}
+
+	if disposition != bigquery.WriteAppend && !done {
+		return "", nil
+	}
+	if disposition == bigquery.WriteAppend && d.load.rows == 0 {
+		return "", nil
+	}
+
+	fence, release := func() error { return nil }, func() {}
+	if disposition != bigquery.WriteAppend {
+		ctx, fence, release, err = s.acquireLease(ctx, d.schema)
+		if err != nil {
+			return "while acquiring lease", err
+		}
+		defer release()
+	}
+
+	table, err := s.operations.CreateTable(ctx, s.dataset, d.schema)
+	if err != nil {
+		return "while creating table", err
+	}
+
+	err = s.checkEncryption(ctx, table, d.schema)
+	if err != nil {
+		return "while verifying table encryption", err
+	}
+
+	if disposition != bigquery.WriteAppend {
+		err = s.checkGuard(ctx, table, table, nil, d.load.rows)
+		if err != nil {
+			return "while checking truncate guard", err
+		}
+
+		err = s.snapshot(ctx, table)
+		if err != nil {
+			return "while taking snapshot of table", err
+		}
+	}
+
+	r, err := d.load.reader()
+	if err != nil {
+		return "while reading load buffer", err
+	}
+
+	err = fence()
+	if err != nil {
+		return "while renewing lease", err
+	}
+
+	loader, ok := s.operations.(Loader)
+	if !ok {
+		return "while loading rows", errLoadUnsupported
+	}
+	err = loader.Load(ctx, table, r, d.schema, disposition)
+	if err != nil {
+		return "while loading rows", fenced(ctx, fence, err)
+	}
+	return "", nil
+}
+
+// checkEncryption verifies that the table is encrypted with the customer-managed key declared by the schema, if any.
+func (s *streamHandler) checkEncryption(ctx context.Context, table *bigquery.Table, schema Schema) error {
+	if schema.KMSKeyName == "" {
+		return nil
+	}
+	md, err := s.metadata(ctx, table)
+	if err != nil {
+		return err
+	}
+	return verifyEncryption(md, schema)
+}
+
+// copyTable copies the source table to the destination table, encrypted with the customer-managed key of the schema,
+// if any.
+func (s *streamHandler) copyTable(ctx context.Context, source, dest *bigquery.Table, schema Schema) error {
+	encryption := encryptionConfig(schema)
+	if encryption == nil {
+		return s.operations.CopyTable(ctx, source, dest)
+	}
+	c, ok := s.operations.(EncryptedCopier)
+	if !ok {
+		return errEncryptionUnsupported
+	}
+	return c.CopyTableEncrypted(ctx, source, dest, encryption)
+}
+
+// metadata fetches the metadata of the table, if the table operations can.
+func (s *streamHandler) metadata(ctx context.Context, table *bigquery.Table) (*bigquery.TableMetadata, error) {
+	r, ok := s.operations.(MetadataReader)
+	if !ok {
+		return nil, errMetadataUnsupported
+	}
+	return r.Metadata(ctx, table)
+}
+
+func (s *streamHandler) orchestration(schema Schema) writeOrchestration {
+	if schema.WriteMethod == LoadJob {
+		return s.writeLoad
+	}
+	if schema.Disposition == bigquery.WriteAppend {
 		return s.writeAppend
 	}
+	if s.stream.opts.viewSwap != nil {
+		return s.writeSwap
+	}
 	return s.writeTruncate
 }
 
-func (s *streamHandler) reportErr(err error, msg string, errorOutput chan<- error) {
-	errorOutput <- errors.Wrap(err, msg)
-	s.metrics.IncCounter(metricsErrors, metrics.DayLabels())
-}
\ No newline at end of file
+// event describes the error, which occurred in the step described by msg, as an event of the current iteration.
+func (s *streamHandler) event(err error, msg string) *ErrorEvent {
+	return &ErrorEvent{
+		Stream:      s.stream.Type(),
+		IterationID: s.iterationID,
+		Step:        stepName(msg),
+		Retryable:   retryable(errorClass(err)),
+		Err:         err,
+		msg:         msg,
+	}
+}
+
+func (s *streamHandler) reportErr(err error, msg string, errorOutput chan<- *ErrorEvent) {
+	s.report(s.event(err, msg), errorOutput)
+}
+
+func (s *streamHandler) report(e *ErrorEvent, errorOutput chan<- *ErrorEvent) {
+	errorOutput <- e
+	s.observer.errored(e.Step, errorClass(e.Err))
+}
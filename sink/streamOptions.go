@@ -0,0 +1,122 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"fmt"
+	"time"
+)
+
+type streamOptionsCollector struct {
+	router       Router
+	insertIDKeys []string
+	deduplicate  bool
+	loadSpoolDir string
+	spoolDir     string
+	spoolAfter   int
+	wal          *WALOptions
+	guard        *TruncateGuard
+	assertions   []Assertion
+	snapshots    *SnapshotOptions
+	viewSwap     *ViewSwapOptions
+
+	producerTimeout time.Duration
+	validation      *ValidationOptions
+	coercion        *CoercionOptions
+	transformers    []Transformer
+}
+
+// saveRows returns true if the options require rows to be saved when received.
+func (c *streamOptionsCollector) saveRows() bool {
+	return c.router != nil || len(c.insertIDKeys) > 0 || c.deduplicate || c.validation != nil ||
+		c.coercion != nil || len(c.transformers) > 0
+}
+
+// StreamOption for configuring a single stream.
+type StreamOption func(collector *streamOptionsCollector)
+
+// Router returns the name of the table that the given row shall be written to. Tables are created lazily, using the
+// schema of the stream as a template where only the table name is replaced.
+type Router func(row map[string]bigquery.Value) (string, error)
+
+// WithRouter makes the stream route each row to the table returned by the given router instead of always writing to
+// the table named in the schema. Rows are buffered and flushed separately per destination table.
+func WithRouter(r Router) StreamOption {
+	return func(collector *streamOptionsCollector) {
+		collector.router = r
+	}
+}
+
+// WithInsertIDKeys makes the stream derive the insertID of each row from the values of the given columns together
+// with the ID of the current iteration, replacing any insertID returned by the row itself. BigQuery uses insertIDs to
+// discard rows that are inserted more than once, for instance when requests are retried.
+func WithInsertIDKeys(columns ...string) StreamOption {
+	return func(collector *streamOptionsCollector) {
+		collector.insertIDKeys = columns
+	}
+}
+
+// WithDeduplication makes the stream drop rows whose insertID has already been received in the current iteration,
+// before they are written. It is usually combined with WithInsertIDKeys. Rows without an insertID are never dropped.
+func WithDeduplication() StreamOption {
+	return func(collector *streamOptionsCollector) {
+		collector.deduplicate = true
+	}
+}
+
+// WithLoadJobSpool makes a stream using the LoadJob write method serialize rows to files in the given directory
+// instead of keeping them in memory until they are loaded.
+func WithLoadJobSpool(dir string) StreamOption {
+	return func(collector *streamOptionsCollector) {
+		collector.loadSpoolDir = dir
+	}
+}
+
+// WithSpool bounds the memory used by the stream. When more than threshold rows are buffered in memory for a
+// destination table, they are spilled to a compressed file in the given directory, and read back in chunks of
+// threshold rows when flushed. This lets large iterations complete without the producer calling Flush.
+func WithSpool(dir string, threshold int) StreamOption {
+	return func(collector *streamOptionsCollector) {
+		collector.spoolDir = dir
+		collector.spoolAfter = threshold
+	}
+}
+
+// WithWriteAheadLog makes the stream append every row to a write-ahead log on local disk before Send returns. Rows
+// are marked as committed in the log once they have been written to the target table, and rows that were not
+// committed are replayed when the stream is started again after a crash. Failed appends are reported and retried, so
+// Send and Complete block for as long as the log cannot be written.
+//
+// Append streams replay all uncommitted rows. Once a write of an append stream has failed, the log is not committed
+// past its rows for the rest of the run, so rows written after them are replayed as well. Truncate streams only
+// replay iterations that were completed, since the rows of an incomplete iteration do not make up a full snapshot;
+// such rows are discarded. Replayed rows hold their values in the JSON representation used by BigQuery, for instance
+// strings for temporal values.
+func WithWriteAheadLog(opts WALOptions) StreamOption {
+	return func(collector *streamOptionsCollector) {
+		collector.wal = &opts
+	}
+}
+
+// DateShardRouter returns a router that writes each row to a date sharded table on the form base_YYYYMMDD, where the
+// date is taken from the time.Time value in the given column.
+func DateShardRouter(base, column string) Router {
+	return func(row map[string]bigquery.Value) (string, error) {
+		t, ok := row[column].(time.Time)
+		if !ok {
+			return "", fmt.Errorf("column %s is not a time.Time, got %T", column, row[column])
+		}
+		return fmt.Sprintf("%s_%s", base, t.UTC().Format("20060102")), nil
+	}
+}
+
+// KeyRouter returns a router that writes each row to a table on the form base_key, where key is the value of the
+// given column.
+func KeyRouter(base, column string) Router {
+	return func(row map[string]bigquery.Value) (string, error) {
+		v, ok := row[column]
+		if !ok || v == nil {
+			return "", fmt.Errorf("column %s has no value", column)
+		}
+		return fmt.Sprintf("%s_%v", base, v), nil
+	}
+}
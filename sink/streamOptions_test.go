@@ -0,0 +1,32 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"testing"
+	"time"
+)
+
+func Test_DateShardRouter(t *testing.T) {
+	r := DateShardRouter("readings", "ts")
+	tests := []struct {
+		name    string
+		row     map[string]bigquery.Value
+		want    string
+		wantErr bool
+	}{
+		{"utc", map[string]bigquery.Value{"ts": time.Date(2026, 10, 17, 9, 16, 1, 1, time.UTC)}, "readings_20261017", false},
+		{"offset", map[string]bigquery.Value{"ts": time.Date(2026, 10, 18, 1, 0, 0, 0, time.FixedZone("CEST", 7200))}, "readings_20261017", false},
+		{"missing", map[string]bigquery.Value{}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r(tt.row)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DateShardRouter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("DateShardRouter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,7 +3,11 @@ package sink
 import (
 	"cloud.google.com/go/bigquery"
 	"context"
+	"errors"
 	"fmt"
+	"google.golang.org/api/iterator"
+	"io"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -27,8 +31,40 @@ type TableOperations interface {
 	TableRef(dataset string, schema Schema) *bigquery.Table
 }
 
+// EncryptedCopier is the encryption-capable extension of TableOperations, needed by streams with a customer-managed
+// key to copy into their target tables. The table operations used by default implement it.
+type EncryptedCopier interface {
+	// CopyTableEncrypted copies the content of the source table to the destination table, which is encrypted with the
+	// given customer-managed key.
+	CopyTableEncrypted(ctx context.Context, source, dest *bigquery.Table, encryption *bigquery.EncryptionConfig) error
+}
+
+// errEncryptionUnsupported is returned when a stream has a customer-managed key but the table operations cannot copy
+// with it.
+var errEncryptionUnsupported = errors.New("table operations do not implement EncryptedCopier")
+
+// MetadataReader is the metadata-capable extension of TableOperations, needed by streams with a customer-managed key
+// to verify the key of existing tables, and by truncate guards and snapshots to count the rows of target tables. The
+// table operations used by default implement it.
+type MetadataReader interface {
+	// Metadata fetches and returns the metadata of the table.
+	Metadata(ctx context.Context, table *bigquery.Table) (*bigquery.TableMetadata, error)
+}
+
+// errMetadataUnsupported is returned when the metadata of a table is needed but the table operations cannot fetch it.
+var errMetadataUnsupported = errors.New("table operations do not implement MetadataReader")
+
 type tableOperations struct {
-	client *bigquery.Client
+	defaultProject string
+	clients        map[string]*bigquery.Client
+}
+
+// client returns the client for the given project, falling back to the client of the default project.
+func (o *tableOperations) client(projectID string) *bigquery.Client {
+	if c, ok := o.clients[projectID]; ok {
+		return c
+	}
+	return o.clients[o.defaultProject]
 }
 
 func (o *tableOperations) Write(ctx context.Context,  table *bigquery.Table, rows []bigquery.ValueSaver) error {
@@ -40,9 +76,8 @@ func (o *tableOperations) Write(ctx context.Context,  table *bigquery.Table, row
 }
 
 func (o *tableOperations) CreateTable(ctx context.Context, dataset string, schema Schema) (*bigquery.Table, error) {
-	client := o.client
-	tableRef := client.Dataset(dataset).Table(schema.BQSchema.Name)
-	if err := tableRef.Create(ctx, schema.BQSchema); err != nil {
+	tableRef := o.TableRef(dataset, schema)
+	if err := tableRef.Create(ctx, tableMetadata(schema)); err != nil {
 		if !strings.Contains(err.Error(), "googleapi: Error 409: Already Exists:") {
 			return nil, err
 		}
@@ -51,12 +86,21 @@ func (o *tableOperations) CreateTable(ctx context.Context, dataset string, schem
 }
 
 func (o *tableOperations) CopyTable(ctx context.Context, source, dest *bigquery.Table) error {
+	return o.CopyTableEncrypted(ctx, source, dest, nil)
+}
+
+func (o *tableOperations) CopyTableEncrypted(ctx context.Context, source, dest *bigquery.Table, encryption *bigquery.EncryptionConfig) error {
+	if err := o.fence(ctx, dest); err != nil {
+		return err
+	}
 	copier := dest.CopierFrom(source)
 	copier.WriteDisposition = bigquery.WriteTruncate
+	copier.DestinationEncryptionConfig = encryption
 	j, err := copier.Run(ctx)
 	if err != nil {
 		return err
 	}
+	recordJob(ctx, j)
 	status, err := j.Wait(ctx)
 	if err != nil {
 		return err
@@ -64,7 +108,41 @@ func (o *tableOperations) CopyTable(ctx context.Context, source, dest *bigquery.
 	if err := status.Err(); err != nil {
 		return err
 	}
-	return nil
+	return o.fence(ctx, dest)
+}
+
+// fence labels the table with the fencing token of the lease in the context, if any, through an update conditioned on
+// the etag of the table. ErrLeaseLost is returned if the table has been labelled with a newer token. Tables that do
+// not exist are left to be created by the write.
+func (o *tableOperations) fence(ctx context.Context, table *bigquery.Table) error {
+	token, ok := LeaseToken(ctx)
+	if !ok {
+		return nil
+	}
+	for {
+		md, err := table.Metadata(ctx)
+		if httpStatus(err) == 404 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkLeaseToken(md, token); err != nil {
+			return err
+		}
+		label := strconv.FormatInt(token, 10)
+		if md.Labels[LeaseTokenLabel] == label {
+			return nil
+		}
+		var update bigquery.TableMetadataToUpdate
+		update.SetLabel(LeaseTokenLabel, label)
+		_, err = table.Update(ctx, update, md.ETag)
+		if httpStatus(err) == 412 {
+			// The table was updated by another replica since it was read.
+			continue
+		}
+		return err
+	}
 }
 
 func (o *tableOperations) DeleteTable(ctx context.Context, table *bigquery.Table) error {
@@ -79,11 +157,218 @@ func (o *tableOperations) DeleteTable(ctx context.Context, table *bigquery.Table
 }
 
 func (o *tableOperations) TableRef(dataset string, schema Schema) *bigquery.Table {
-	return o.client.Dataset(dataset).Table(schema.BQSchema.Name)
+	return o.client(schema.ProjectID).Dataset(dataset).Table(schema.BQSchema.Name)
+}
+
+func (o *tableOperations) Load(ctx context.Context, table *bigquery.Table, source io.Reader, schema Schema, disposition bigquery.TableWriteDisposition) error {
+	if disposition == bigquery.WriteTruncate {
+		if err := o.fence(ctx, table); err != nil {
+			return err
+		}
+	}
+	src := bigquery.NewReaderSource(source)
+	src.SourceFormat = bigquery.JSON
+	src.Schema = schema.BQSchema.Schema
+	loader := table.LoaderFrom(src)
+	loader.WriteDisposition = disposition
+	loader.DestinationEncryptionConfig = encryptionConfig(schema)
+	j, err := loader.Run(ctx)
+	if err != nil {
+		return err
+	}
+	recordJob(ctx, j)
+	status, err := j.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	if err := status.Err(); err != nil {
+		return err
+	}
+	if disposition == bigquery.WriteTruncate {
+		return o.fence(ctx, table)
+	}
+	return nil
+}
+
+func (o *tableOperations) Query(ctx context.Context, projectID, sql string, params ...bigquery.QueryParameter) ([]map[string]bigquery.Value, error) {
+	q := o.client(projectID).Query(sql)
+	q.Parameters = params
+	j, err := q.Run(ctx)
+	if err != nil {
+		return nil, err
+	}
+	recordJob(ctx, j)
+	it, err := j.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var rows []map[string]bigquery.Value
+	for {
+		row := map[string]bigquery.Value{}
+		err := it.Next(&row)
+		if err == iterator.Done {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+}
+
+func (o *tableOperations) Snapshot(ctx context.Context, source, snapshot *bigquery.Table, expiration time.Time) error {
+	copier := snapshot.CopierFrom(source)
+	copier.OperationType = bigquery.SnapshotOperation
+	j, err := copier.Run(ctx)
+	if err != nil {
+		return err
+	}
+	recordJob(ctx, j)
+	status, err := j.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	if err := status.Err(); err != nil {
+		return err
+	}
+	if expiration.IsZero() {
+		return nil
+	}
+	_, err = snapshot.Update(ctx, bigquery.TableMetadataToUpdate{ExpirationTime: expiration}, "")
+	return err
+}
+
+func (o *tableOperations) Restore(ctx context.Context, snapshot, dest *bigquery.Table, encryption *bigquery.EncryptionConfig) error {
+	copier := dest.CopierFrom(snapshot)
+	copier.OperationType = bigquery.RestoreOperation
+	copier.WriteDisposition = bigquery.WriteTruncate
+	copier.DestinationEncryptionConfig = encryption
+	j, err := copier.Run(ctx)
+	if err != nil {
+		return err
+	}
+	recordJob(ctx, j)
+	status, err := j.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	if err := status.Err(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (o *tableOperations) ListTables(ctx context.Context, projectID, datasetID, prefix string) ([]*bigquery.Table, error) {
+	var tables []*bigquery.Table
+	it := o.client(projectID).Dataset(datasetID).Tables(ctx)
+	for {
+		t, err := it.Next()
+		if err == iterator.Done {
+			return tables, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(t.TableID, prefix) {
+			tables = append(tables, t)
+		}
+	}
+}
+
+func (o *tableOperations) ViewTarget(ctx context.Context, view *bigquery.Table) (*bigquery.Table, error) {
+	md, err := view.Metadata(ctx)
+	if err != nil {
+		if strings.Contains(err.Error(), "googleapi: Error 404: Not found:") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if md.Type != bigquery.ViewTable {
+		return nil, fmt.Errorf("table %s is not a view", view.TableID)
+	}
+	project, dataset, table, err := parseViewQuery(md.ViewQuery)
+	if err != nil {
+		return nil, err
+	}
+	return o.client(project).DatasetInProject(project, dataset).Table(table), nil
+}
+
+// PointView points the view to the target. Under a lease, the view is labelled with the fencing token in the same
+// update, and ErrLeaseLost is returned if it has been labelled with a newer token.
+func (o *tableOperations) PointView(ctx context.Context, view, target *bigquery.Table) error {
+	token, fenced := LeaseToken(ctx)
+	md, err := view.Metadata(ctx)
+	if err != nil {
+		if !strings.Contains(err.Error(), "googleapi: Error 404: Not found:") {
+			return err
+		}
+		create := &bigquery.TableMetadata{ViewQuery: viewQuery(target)}
+		if fenced {
+			create.Labels = map[string]string{LeaseTokenLabel: strconv.FormatInt(token, 10)}
+		}
+		return view.Create(ctx, create)
+	}
+	update := bigquery.TableMetadataToUpdate{ViewQuery: viewQuery(target)}
+	if fenced {
+		if err := checkLeaseToken(md, token); err != nil {
+			return err
+		}
+		update.SetLabel(LeaseTokenLabel, strconv.FormatInt(token, 10))
+	}
+	// The etag makes the update fail rather than overwrite a concurrent change to the view.
+	_, err = view.Update(ctx, update, md.ETag)
+	return err
+}
+
+func (o *tableOperations) ExpireTable(ctx context.Context, table *bigquery.Table, expiration time.Time) error {
+	_, err := table.Update(ctx, bigquery.TableMetadataToUpdate{ExpirationTime: expiration}, "")
+	return err
+}
+
+func (o *tableOperations) Metadata(ctx context.Context, table *bigquery.Table) (*bigquery.TableMetadata, error) {
+	return table.Metadata(ctx)
+}
+
+// tableMetadata returns the metadata used when creating the table described by the schema.
+func tableMetadata(s Schema) *bigquery.TableMetadata {
+	if s.KMSKeyName == "" {
+		return s.BQSchema
+	}
+	md := *s.BQSchema
+	md.EncryptionConfig = encryptionConfig(s)
+	return &md
+}
+
+// encryptionConfig returns the encryption config for tables written by the schema, or nil if the schema does not
+// declare a customer-managed key.
+func encryptionConfig(s Schema) *bigquery.EncryptionConfig {
+	if s.KMSKeyName == "" {
+		return nil
+	}
+	return &bigquery.EncryptionConfig{KMSKeyName: s.KMSKeyName}
+}
+
+// verifyEncryption returns an error if the schema declares a customer-managed key and the table is not encrypted
+// with that key.
+func verifyEncryption(md *bigquery.TableMetadata, s Schema) error {
+	if s.KMSKeyName == "" {
+		return nil
+	}
+	actual := ""
+	if md.EncryptionConfig != nil {
+		actual = md.EncryptionConfig.KMSKeyName
+	}
+	// The key name reported by BigQuery may carry a version suffix, /cryptoKeyVersions/N.
+	if actual != s.KMSKeyName && !strings.HasPrefix(actual, s.KMSKeyName+"/cryptoKeyVersions/") {
+		return fmt.Errorf("table %s is encrypted with key %q, expected %q", s.BQSchema.Name, actual, s.KMSKeyName)
+	}
+	return nil
 }
 
+// tempTable returns the name of a temporary table created at the given time. The name includes the nanoseconds, so
+// that an iteration retried shortly after a rejected one does not write to the temporary table of the rejected one.
 func tempTable(base string, d time.Time) string {
-	return fmt.Sprintf("%s_%s", base, d.Format("200601021504"))
+	return fmt.Sprintf("%s_%s%09d", base, d.Format("20060102150405"), d.Nanosecond())
 }
 
 func tempTableSchema(table string, s Schema) Schema {
@@ -93,5 +378,8 @@ func tempTableSchema(table string, s Schema) Schema {
 			Schema: s.BQSchema.Schema,
 		},
 		Disposition: bigquery.WriteEmpty,
+		ProjectID:   s.ProjectID,
+		DatasetID:   s.DatasetID,
+		KMSKeyName:  s.KMSKeyName,
 	}
 }
\ No newline at end of file
@@ -1,6 +1,7 @@
 package sink
 
 import (
+	"cloud.google.com/go/bigquery"
 	"testing"
 	"time"
 )
@@ -15,7 +16,8 @@ func Test_tempTable(t *testing.T) {
 		args args
 		want string
 	}{
-		{"1", args{"basetable", time.Date(2021, 10, 30, 9, 16, 1, 1, time.UTC)}, "basetable_202110300916"},
+		{"1", args{"basetable", time.Date(2021, 10, 30, 9, 16, 1, 1, time.UTC)}, "basetable_20211030091601000000001"},
+		{"2", args{"basetable", time.Date(2021, 10, 30, 9, 16, 1, 2, time.UTC)}, "basetable_20211030091601000000002"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -25,3 +27,28 @@ func Test_tempTable(t *testing.T) {
 		})
 	}
 }
+
+func Test_verifyEncryption(t *testing.T) {
+	const key = "projects/p/locations/eu/keyRings/r/cryptoKeys/k"
+	tests := []struct {
+		name    string
+		actual  *bigquery.EncryptionConfig
+		want    string
+		wantErr bool
+	}{
+		{"no key required", nil, "", false},
+		{"same key", &bigquery.EncryptionConfig{KMSKeyName: key}, key, false},
+		{"key version", &bigquery.EncryptionConfig{KMSKeyName: key + "/cryptoKeyVersions/3"}, key, false},
+		{"other key", &bigquery.EncryptionConfig{KMSKeyName: key + "2"}, key, true},
+		{"not encrypted", nil, key, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := &bigquery.TableMetadata{Name: "t", EncryptionConfig: tt.actual}
+			s := Schema{BQSchema: md, KMSKeyName: tt.want}
+			if err := verifyEncryption(md, s); (err != nil) != tt.wantErr {
+				t.Errorf("verifyEncryption() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+)
+
+const tracerName = "github.com/3lvia/edna-writer-go/sink"
+
+const (
+	attrStream    = attribute.Key("sink.stream")
+	attrIteration = attribute.Key("sink.iteration_id")
+	attrRows      = attribute.Key("sink.rows")
+	attrTables    = attribute.Key("sink.tables")
+	attrProject   = attribute.Key("bigquery.project")
+	attrDataset   = attribute.Key("bigquery.dataset")
+	attrTable     = attribute.Key("bigquery.table")
+	attrJobID     = attribute.Key("bigquery.job_id")
+)
+
+// traceLinks collects the span contexts of the producer calls since the last flush, so that the span of the flush can
+// link to the spans that the producer started around Send and Complete.
+type traceLinks struct {
+	mux   *sync.Mutex
+	links []trace.Link
+	seen  map[trace.SpanID]bool
+}
+
+func newTraceLinks() *traceLinks {
+	return &traceLinks{mux: &sync.Mutex{}, seen: map[trace.SpanID]bool{}}
+}
+
+// add remembers the span in the context, if any. Each span is linked once.
+func (l *traceLinks) add(ctx context.Context) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.seen[sc.SpanID()] {
+		return
+	}
+	l.seen[sc.SpanID()] = true
+	l.links = append(l.links, trace.Link{SpanContext: sc})
+}
+
+// drain returns the links collected since the last call.
+func (l *traceLinks) drain() []trace.Link {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	links := l.links
+	l.links = nil
+	l.seen = map[trace.SpanID]bool{}
+	return links
+}
+
+// tableAttributes describes the table in span attributes.
+func tableAttributes(table *bigquery.Table) []attribute.KeyValue {
+	if table == nil {
+		return nil
+	}
+	return []attribute.KeyValue{
+		attrProject.String(table.ProjectID),
+		attrDataset.String(table.DatasetID),
+		attrTable.String(table.TableID),
+	}
+}
+
+// recordJob adds the ID of the BigQuery job to the span in the context, and to the job IDs collected for logging.
+func recordJob(ctx context.Context, j *bigquery.Job) {
+	trace.SpanFromContext(ctx).SetAttributes(attrJobID.String(j.ID()))
+	if jobs, ok := ctx.Value(jobsKey{}).(*jobIDs); ok {
+		jobs.add(j.ID())
+	}
+}
+
+// endSpan records the error on the span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
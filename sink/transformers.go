@@ -0,0 +1,164 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+const metricsTransformedRows = `sink_transformed_rows`
+
+// Transformer transforms the rows received on a stream before they are buffered.
+type Transformer struct {
+	// Name identifies the transformer in errors and metrics.
+	Name string
+
+	// Transform returns the rows that the row is transformed into. It may modify the row it is given and return it,
+	// return no rows to filter the row out, or return several rows to split it. An error rejects the row.
+	Transform func(row map[string]bigquery.Value) ([]map[string]bigquery.Value, error)
+}
+
+// TransformerError is reported for rows rejected by a transformer.
+type TransformerError struct {
+	// Transformer is the name of the transformer that rejected the row.
+	Transformer string
+
+	// Err is the error returned by the transformer.
+	Err error
+}
+
+func (e *TransformerError) Error() string {
+	return fmt.Sprintf("transformer %s rejected row: %v", e.Transformer, e.Err)
+}
+
+func (e *TransformerError) Unwrap() error {
+	return e.Err
+}
+
+// SetColumn sets the column to the value returned by fn for the row, adding the column if the row lacks it.
+func SetColumn(column string, fn func(row map[string]bigquery.Value) (bigquery.Value, error)) Transformer {
+	return Transformer{
+		Name: "set_" + column,
+		Transform: func(row map[string]bigquery.Value) ([]map[string]bigquery.Value, error) {
+			v, err := fn(row)
+			if err != nil {
+				return nil, err
+			}
+			row[column] = v
+			return []map[string]bigquery.Value{row}, nil
+		},
+	}
+}
+
+// RenameColumn renames the column from to the column to. Rows without the column from are passed on unchanged.
+func RenameColumn(from, to string) Transformer {
+	return Transformer{
+		Name: "rename_" + from,
+		Transform: func(row map[string]bigquery.Value) ([]map[string]bigquery.Value, error) {
+			if v, ok := row[from]; ok {
+				delete(row, from)
+				row[to] = v
+			}
+			return []map[string]bigquery.Value{row}, nil
+		},
+	}
+}
+
+// DropColumns removes the given columns from the rows.
+func DropColumns(columns ...string) Transformer {
+	return Transformer{
+		Name: "drop_columns",
+		Transform: func(row map[string]bigquery.Value) ([]map[string]bigquery.Value, error) {
+			for _, c := range columns {
+				delete(row, c)
+			}
+			return []map[string]bigquery.Value{row}, nil
+		},
+	}
+}
+
+// MaskColumns replaces the values of the given columns with the hex encoded SHA-256 hash of their text
+// representation, so that rows can still be joined and counted on them. NULL values are kept.
+func MaskColumns(columns ...string) Transformer {
+	return Transformer{
+		Name: "mask_columns",
+		Transform: func(row map[string]bigquery.Value) ([]map[string]bigquery.Value, error) {
+			for _, c := range columns {
+				v := unwrapNull(row[c])
+				if v == nil {
+					continue
+				}
+				sum := sha256.Sum256([]byte(fmt.Sprint(v)))
+				row[c] = hex.EncodeToString(sum[:])
+			}
+			return []map[string]bigquery.Value{row}, nil
+		},
+	}
+}
+
+// FilterRows passes on only the rows for which keep returns true.
+func FilterRows(name string, keep func(row map[string]bigquery.Value) bool) Transformer {
+	return Transformer{
+		Name: name,
+		Transform: func(row map[string]bigquery.Value) ([]map[string]bigquery.Value, error) {
+			if !keep(row) {
+				return nil, nil
+			}
+			return []map[string]bigquery.Value{row}, nil
+		},
+	}
+}
+
+// WithTransformers makes the stream pass every row received through the given transformers, in order, before it is
+// coerced, validated and buffered. Each row returned by a transformer is passed to the next. Rows rejected by a
+// transformer are not written, and a *TransformerError is reported for each of them. Rows split by a transformer keep
+// the insertID of the original row suffixed with their index, unless insertIDs are derived with WithInsertID.
+func WithTransformers(transformers ...Transformer) StreamOption {
+	return func(collector *streamOptionsCollector) {
+		collector.transformers = append(collector.transformers, transformers...)
+	}
+}
+
+// transform passes the row through the transformers of the stream and returns the resulting rows. Rejected rows are
+// reported, and false is returned for them.
+func (s *streamHandler) transform(row *savedRow, errorOutput chan<- *ErrorEvent) ([]*savedRow, bool) {
+	copied := make(map[string]bigquery.Value, len(row.row))
+	for k, v := range row.row {
+		copied[k] = v
+	}
+	rows := []map[string]bigquery.Value{copied}
+
+	for _, t := range s.stream.opts.transformers {
+		var out []map[string]bigquery.Value
+		for _, r := range rows {
+			transformed, err := t.Transform(r)
+			if err != nil {
+				s.observer.transformed(t.Name, "rejected")
+				e := s.event(&TransformerError{Transformer: t.Name, Err: err}, "while transforming row")
+				e.Rows = 1
+				s.report(e, errorOutput)
+				return nil, false
+			}
+			switch len(transformed) {
+			case 0:
+				s.observer.transformed(t.Name, "filtered")
+			case 1:
+				s.observer.transformed(t.Name, "passed")
+			default:
+				s.observer.transformed(t.Name, "split")
+			}
+			out = append(out, transformed...)
+		}
+		rows = out
+	}
+
+	saved := make([]*savedRow, len(rows))
+	for i, r := range rows {
+		saved[i] = &savedRow{row: r, insertID: row.insertID}
+		if len(rows) > 1 && row.insertID != "" {
+			saved[i].insertID = fmt.Sprintf("%s-%d", row.insertID, i)
+		}
+	}
+	return saved, true
+}
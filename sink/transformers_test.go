@@ -0,0 +1,55 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func Test_Transformers(t *testing.T) {
+	row := func() map[string]bigquery.Value {
+		return map[string]bigquery.Value{"id": 1, "name": "Ola", "ssn": "01019012345"}
+	}
+	tests := []struct {
+		transformer Transformer
+		want        []map[string]bigquery.Value
+	}{
+		{
+			SetColumn("source", func(row map[string]bigquery.Value) (bigquery.Value, error) { return "meter", nil }),
+			[]map[string]bigquery.Value{{"id": 1, "name": "Ola", "ssn": "01019012345", "source": "meter"}},
+		},
+		{
+			RenameColumn("name", "full_name"),
+			[]map[string]bigquery.Value{{"id": 1, "full_name": "Ola", "ssn": "01019012345"}},
+		},
+		{
+			DropColumns("ssn", "missing"),
+			[]map[string]bigquery.Value{{"id": 1, "name": "Ola"}},
+		},
+		{
+			MaskColumns("ssn"),
+			[]map[string]bigquery.Value{{"id": 1, "name": "Ola", "ssn": hash("01019012345")}},
+		},
+		{
+			FilterRows("only_even", func(row map[string]bigquery.Value) bool { return row["id"].(int)%2 == 0 }),
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		got, err := tt.transformer.Transform(row())
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.transformer.Name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.transformer.Name, tt.want, got)
+		}
+	}
+}
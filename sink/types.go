@@ -1,11 +1,30 @@
 package sink
 
-import "cloud.google.com/go/bigquery"
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"sync"
+	"time"
+)
 
 // Schema wraps the BigQuery schema and write disposition.
 type Schema struct {
-	BQSchema         *bigquery.TableMetadata
-	Disposition      bigquery.TableWriteDisposition
+	BQSchema    *bigquery.TableMetadata
+	Disposition bigquery.TableWriteDisposition
+
+	// ProjectID overrides the Google project set with WithBigQuery for this stream. If empty, the default project is
+	// used.
+	ProjectID string
+
+	// DatasetID overrides the dataset set with WithBigQuery for this stream. If empty, the default dataset is used.
+	DatasetID string
+
+	// WriteMethod decides how rows are written. The default is streaming inserts.
+	WriteMethod WriteMethod
+
+	// KMSKeyName is the Cloud KMS key that the target table, temporary tables and copy destinations are encrypted
+	// with. If empty, the key set with WithKMSKeyName is used, if any.
+	KMSKeyName string
 }
 
 // SourceStream is the streamImpl that the source of the data that shall be written to BigQuery uses in order to communicate
@@ -27,14 +46,55 @@ type SourceStream interface {
 	Complete()
 }
 
+// ContextStream is the extension of SourceStream for producers that pass their own context, linking their spans from
+// the spans of the sink. The streams returned by Stream implement it.
+type ContextStream interface {
+	SourceStream
+
+	// SendContext is like Send. If the context carries a span, the span of the flush or completion that writes the
+	// value links to it.
+	SendContext(ctx context.Context, v bigquery.ValueSaver)
+
+	// SendAllContext is like SendAll, linking the span in the context as SendContext does.
+	SendAllContext(ctx context.Context, v []bigquery.ValueSaver)
+
+	// FlushContext is like Flush. The span of the flush links to the span in the context, if any.
+	FlushContext(ctx context.Context)
+
+	// CompleteContext is like Complete. The span of the completion links to the span in the context, if any.
+	CompleteContext(ctx context.Context)
+}
+
+// IdentifiedStream is the extension of SourceStream for producers that identify their iterations. The streams returned
+// by Stream implement it.
+type IdentifiedStream interface {
+	SourceStream
+
+	// SetIterationID sets the ID of the current iteration. It must be called before the first row of the iteration is
+	// sent. If not called, an ID is generated. Producers that re-run iterations after failures should use stable IDs,
+	// so that the iteration ledger can tell whether an iteration has already been committed.
+	SetIterationID(id string)
+}
+
 type streamImpl struct {
-	typ    string
-	schema Schema
+	typ     string
+	schema  Schema
+	opts    *streamOptionsCollector
+	wal     *wal
+	started bool
 
-	object chan bigquery.ValueSaver
-	list   chan []bigquery.ValueSaver
-	flush  chan struct{}
-	done   chan struct{}
+	object    chan bigquery.ValueSaver
+	list      chan []bigquery.ValueSaver
+	flush     chan struct{}
+	done      chan struct{}
+	iteration chan string
+	errs      chan error
+	control   chan func(s *streamHandler)
+	commands  chan iterationCommand
+	mux       *sync.Mutex
+	open      bool
+	links     *traceLinks
+	health    *healthState
 }
 
 func (s *streamImpl) Type() string {
@@ -42,11 +102,63 @@ func (s *streamImpl) Type() string {
 }
 
 func (s *streamImpl) Send(v bigquery.ValueSaver) {
-	s.object <- v
+	s.object <- s.logged(v)
 }
 
 func (s *streamImpl) SendAll(v []bigquery.ValueSaver) {
-	s.list <- v
+	if s.wal == nil {
+		s.list <- v
+		return
+	}
+	logged := make([]bigquery.ValueSaver, len(v))
+	for i, r := range v {
+		logged[i] = s.logged(r)
+	}
+	s.list <- logged
+}
+
+// logged appends the row to the write-ahead log of the stream, if any. The producer is blocked until the row is in the
+// log, see retryLog. Rows that cannot be encoded for the log are reported and sent without its guarantees.
+func (s *streamImpl) logged(v bigquery.ValueSaver) bigquery.ValueSaver {
+	if s.wal == nil {
+		return v
+	}
+	row, b, err := walRecord(s.schema.BQSchema.Schema, v)
+	if err != nil {
+		s.errs <- err
+		return v
+	}
+	var entry *walEntry
+	s.retryLog(func() error {
+		entry, err = s.wal.appendRecord(row, b)
+		return err
+	})
+	return entry
+}
+
+// logComplete appends a completion marker to the write-ahead log of the stream, if any, retrying as retryLog does.
+func (s *streamImpl) logComplete() {
+	if s.wal != nil {
+		s.retryLog(s.wal.appendComplete)
+	}
+}
+
+// retryLog calls fn until it succeeds. Every failure is passed on to the handler, which reports it, and fn is retried
+// after a backoff that doubles up to walMaxRetryBackoff. A log that keeps failing, for instance on a full disk, thus
+// blocks the producer rather than letting rows past that would be lost in a crash.
+func (s *streamImpl) retryLog(fn func() error) {
+	backoff := walRetryBackoff
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+		s.errs <- err
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > walMaxRetryBackoff {
+			backoff = walMaxRetryBackoff
+		}
+	}
 }
 
 func (s *streamImpl) Flush() {
@@ -54,5 +166,30 @@ func (s *streamImpl) Flush() {
 }
 
 func (s *streamImpl) Complete() {
+	s.logComplete()
 	s.done <- struct{}{}
 }
+
+func (s *streamImpl) SendContext(ctx context.Context, v bigquery.ValueSaver) {
+	s.Send(v)
+	s.links.add(ctx)
+}
+
+func (s *streamImpl) SendAllContext(ctx context.Context, v []bigquery.ValueSaver) {
+	s.SendAll(v)
+	s.links.add(ctx)
+}
+
+func (s *streamImpl) FlushContext(ctx context.Context) {
+	s.links.add(ctx)
+	s.Flush()
+}
+
+func (s *streamImpl) CompleteContext(ctx context.Context) {
+	s.links.add(ctx)
+	s.Complete()
+}
+
+func (s *streamImpl) SetIterationID(id string) {
+	s.iteration <- id
+}
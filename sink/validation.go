@@ -0,0 +1,336 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const metricsInvalidRows = `sink_invalid_rows`
+
+// FieldError describes why the value of a single field is invalid.
+type FieldError struct {
+	// Field is the path of the field, such as "address.city" or "tags[2]".
+	Field string
+
+	// Reason describes what is wrong with the value.
+	Reason string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Reason
+}
+
+// ValidationError is the error returned by Validate, and reported for rows that fail validation.
+type ValidationError struct {
+	// Errors holds an error for each invalid field of the row.
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.Error()
+	}
+	return "invalid row: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks the row, as returned by Save, against the schema. A *ValidationError listing every invalid field
+// is returned if the row has columns that are not in the schema, lacks values for REQUIRED fields, has values of Go
+// types that do not match the types of the fields, such as a time.Time for a TIME field that expects a civil.Time, has
+// RECORD and REPEATED fields of the wrong shape, or has NUMERIC and BIGNUMERIC values exceeding their precision.
+func Validate(schema bigquery.Schema, row map[string]bigquery.Value) error {
+	v := &validator{}
+	v.record("", schema, row)
+	if len(v.errs) > 0 {
+		return &ValidationError{Errors: v.errs}
+	}
+	return nil
+}
+
+type validator struct {
+	errs []FieldError
+}
+
+func (v *validator) fail(field, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{Field: field, Reason: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) record(prefix string, schema bigquery.Schema, row map[string]bigquery.Value) {
+	known := map[string]bool{}
+	for _, f := range schema {
+		known[f.Name] = true
+		v.field(prefix+f.Name, f, row[f.Name])
+	}
+	for _, k := range sortedKeys(row) {
+		if !known[k] {
+			v.fail(prefix+k, "column is not in the schema")
+		}
+	}
+}
+
+func (v *validator) field(path string, f *bigquery.FieldSchema, value interface{}) {
+	value = unwrapNull(value)
+	if value == nil {
+		if f.Required {
+			v.fail(path, "value is required")
+		}
+		return
+	}
+	if !f.Repeated {
+		v.value(path, f, value)
+		return
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice || rv.Type().Elem().Kind() == reflect.Uint8 {
+		v.fail(path, "repeated field expects a slice, got %T", value)
+		return
+	}
+	for i := 0; i < rv.Len(); i++ {
+		elem := unwrapNull(rv.Index(i).Interface())
+		if elem == nil {
+			v.fail(fmt.Sprintf("%s[%d]", path, i), "repeated field cannot hold null")
+			continue
+		}
+		v.value(fmt.Sprintf("%s[%d]", path, i), f, elem)
+	}
+}
+
+func (v *validator) value(path string, f *bigquery.FieldSchema, value interface{}) {
+	ok := true
+	switch f.Type {
+	case bigquery.StringFieldType, bigquery.GeographyFieldType:
+		_, ok = value.(string)
+	case bigquery.BytesFieldType:
+		_, ok = value.([]byte)
+	case bigquery.IntegerFieldType:
+		ok = isInteger(value)
+	case bigquery.FloatFieldType:
+		switch value.(type) {
+		case float32, float64:
+		default:
+			ok = isInteger(value)
+		}
+	case bigquery.BooleanFieldType:
+		_, ok = value.(bool)
+	case bigquery.TimestampFieldType:
+		_, ok = value.(time.Time)
+	case bigquery.DateFieldType:
+		_, ok = value.(civil.Date)
+	case bigquery.TimeFieldType:
+		_, ok = value.(civil.Time)
+	case bigquery.DateTimeFieldType:
+		_, ok = value.(civil.DateTime)
+	case bigquery.NumericFieldType:
+		ok = v.numeric(path, value, bigquery.NumericPrecisionDigits, bigquery.NumericScaleDigits)
+	case bigquery.BigNumericFieldType:
+		ok = v.numeric(path, value, bigquery.BigNumericPrecisionDigits, bigquery.BigNumericScaleDigits)
+	case bigquery.RecordFieldType:
+		switch r := value.(type) {
+		case map[string]bigquery.Value:
+			v.record(path+".", f.Schema, r)
+		case map[string]interface{}:
+			m := make(map[string]bigquery.Value, len(r))
+			for k, x := range r {
+				m[k] = x
+			}
+			v.record(path+".", f.Schema, m)
+		default:
+			ok = false
+		}
+	}
+	if !ok {
+		v.fail(path, "%s field does not accept %T", f.Type, value)
+	}
+}
+
+// numeric checks that the value fits the precision and scale of the numeric type. False is returned if the value is
+// not of a numeric Go type at all. Values of the right type that exceed the precision are reported here.
+func (v *validator) numeric(path string, value interface{}, precision, scale int) bool {
+	if isInteger(value) {
+		return true
+	}
+	r, ok := value.(*big.Rat)
+	if !ok {
+		return false
+	}
+	pow := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)
+	if new(big.Int).Mod(pow, r.Denom()).Sign() != 0 {
+		v.fail(path, "value %s has more than %d digits after the decimal point", r.RatString(), scale)
+		return true
+	}
+	whole := new(big.Int).Quo(new(big.Int).Abs(r.Num()), r.Denom())
+	if whole.Sign() != 0 && len(whole.String()) > precision-scale {
+		v.fail(path, "value %s has more than %d digits before the decimal point", r.RatString(), precision-scale)
+	}
+	return true
+}
+
+func isInteger(value interface{}) bool {
+	switch value.(type) {
+	case int, int8, int16, int32, int64, uint8, uint16, uint32:
+		return true
+	}
+	return false
+}
+
+// unwrapNull returns the value held by the nullable types of the bigquery package, or nil if it is not valid.
+func unwrapNull(value interface{}) interface{} {
+	switch n := value.(type) {
+	case bigquery.NullString:
+		return nullable(n.Valid, n.StringVal)
+	case bigquery.NullGeography:
+		return nullable(n.Valid, n.GeographyVal)
+	case bigquery.NullInt64:
+		return nullable(n.Valid, n.Int64)
+	case bigquery.NullFloat64:
+		return nullable(n.Valid, n.Float64)
+	case bigquery.NullBool:
+		return nullable(n.Valid, n.Bool)
+	case bigquery.NullTimestamp:
+		return nullable(n.Valid, n.Timestamp)
+	case bigquery.NullDate:
+		return nullable(n.Valid, n.Date)
+	case bigquery.NullTime:
+		return nullable(n.Valid, n.Time)
+	case bigquery.NullDateTime:
+		return nullable(n.Valid, n.DateTime)
+	}
+	return value
+}
+
+func nullable(valid bool, value interface{}) interface{} {
+	if !valid {
+		return nil
+	}
+	return value
+}
+
+func sortedKeys(row map[string]bigquery.Value) []string {
+	keys := make([]string, 0, len(row))
+	for k := range row {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ValidationOptions configures the validation of rows received on a stream.
+type ValidationOptions struct {
+	// DeadLetterTable is the name of a table in the dataset of the stream that invalid rows are appended to, together
+	// with the validation error. If empty, invalid rows are discarded.
+	DeadLetterTable string
+}
+
+// WithValidation makes the stream validate every row against the schema of the stream with Validate when it is
+// received. Invalid rows are not written to the target table. A *ValidationError is reported for each of them, and
+// they are appended to the dead-letter table, if any, when the stream is flushed or completed.
+func WithValidation(opts ValidationOptions) StreamOption {
+	return func(collector *streamOptionsCollector) {
+		collector.validation = &opts
+	}
+}
+
+// deadLetter is a row in the dead-letter table.
+type deadLetter struct {
+	stream      string
+	iterationID string
+	err         string
+	row         string
+	receivedAt  time.Time
+}
+
+func (d *deadLetter) Save() (map[string]bigquery.Value, string, error) {
+	return map[string]bigquery.Value{
+		"stream":       d.stream,
+		"iteration_id": d.iterationID,
+		"error":        d.err,
+		"row":          d.row,
+		"received_at":  d.receivedAt,
+	}, "", nil
+}
+
+// deadLetterSchema returns the schema of the dead-letter table in the dataset written to by the stream schema.
+func deadLetterSchema(table string, s Schema) Schema {
+	return Schema{
+		BQSchema: &bigquery.TableMetadata{
+			Name:        table,
+			Description: "Rows rejected by the validation of the sink",
+			Schema: bigquery.Schema{
+				{Name: "stream", Type: bigquery.StringFieldType, Required: true},
+				{Name: "iteration_id", Type: bigquery.StringFieldType},
+				{Name: "error", Type: bigquery.StringFieldType, Required: true},
+				{Name: "row", Type: bigquery.StringFieldType},
+				{Name: "received_at", Type: bigquery.TimestampFieldType},
+			},
+		},
+		Disposition: bigquery.WriteAppend,
+		ProjectID:   s.ProjectID,
+		DatasetID:   s.DatasetID,
+		KMSKeyName:  s.KMSKeyName,
+	}
+}
+
+// validate validates the row against the schema of the stream. Invalid rows are rejected. False is returned if the
+// row is invalid.
+func (s *streamHandler) validate(row map[string]bigquery.Value, errorOutput chan<- *ErrorEvent) bool {
+	err := Validate(s.stream.schema.BQSchema.Schema, row)
+	if err == nil {
+		return true
+	}
+	s.reject(row, err, "while validating row", errorOutput)
+	return false
+}
+
+// reject reports a row rejected by coercion or validation, and keeps it for the dead-letter table if the stream has
+// one.
+func (s *streamHandler) reject(row map[string]bigquery.Value, err error, msg string, errorOutput chan<- *ErrorEvent) {
+	s.observer.invalid()
+	e := s.event(err, msg)
+	e.Rows = 1
+	s.report(e, errorOutput)
+
+	opts := s.stream.opts.validation
+	if opts == nil || opts.DeadLetterTable == "" {
+		return
+	}
+	b, jerr := json.Marshal(row)
+	if jerr != nil {
+		b = []byte(fmt.Sprint(row))
+	}
+	s.deadLetters = append(s.deadLetters, &deadLetter{
+		stream:      s.stream.Type(),
+		iterationID: s.iterationID,
+		err:         err.Error(),
+		row:         string(b),
+		receivedAt:  time.Now().UTC(),
+	})
+}
+
+// writeDeadLetters appends the invalid rows kept since the last flush to the dead-letter table.
+func (s *streamHandler) writeDeadLetters(ctx context.Context) error {
+	if len(s.deadLetters) == 0 {
+		return nil
+	}
+	if s.deadLetterRef == nil {
+		schema := deadLetterSchema(s.stream.opts.validation.DeadLetterTable, s.stream.schema)
+		t, err := s.operations.CreateTable(ctx, s.dataset, schema)
+		if err != nil {
+			return err
+		}
+		s.deadLetterRef = t
+	}
+	err := s.operations.Write(ctx, s.deadLetterRef, s.deadLetters)
+	if err != nil {
+		return err
+	}
+	s.deadLetters = nil
+	return nil
+}
@@ -0,0 +1,66 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_Validate(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType, Required: true},
+		{Name: "at", Type: bigquery.TimeFieldType},
+		{Name: "amount", Type: bigquery.NumericFieldType},
+		{Name: "tags", Type: bigquery.StringFieldType, Repeated: true},
+		{Name: "address", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "city", Type: bigquery.StringFieldType, Required: true},
+		}},
+	}
+
+	valid := map[string]bigquery.Value{
+		"id":      42,
+		"at":      civil.Time{Hour: 14, Minute: 5},
+		"amount":  big.NewRat(12345, 100),
+		"tags":    []string{"a", "b"},
+		"address": map[string]bigquery.Value{"city": "Oslo"},
+	}
+	if err := Validate(schema, valid); err != nil {
+		t.Errorf("expected the row to be valid, got %v", err)
+	}
+	if err := Validate(schema, map[string]bigquery.Value{"id": bigquery.NullInt64{Int64: 1, Valid: true}}); err != nil {
+		t.Errorf("expected nullable values to be accepted, got %v", err)
+	}
+
+	tests := []struct {
+		row  map[string]bigquery.Value
+		want []string
+	}{
+		{map[string]bigquery.Value{"id": 1, "extra": "x"}, []string{"extra"}},
+		{map[string]bigquery.Value{"at": civil.Time{}}, []string{"id"}},
+		{map[string]bigquery.Value{"id": 1, "at": time.Now()}, []string{"at"}},
+		{map[string]bigquery.Value{"id": 1, "tags": "a"}, []string{"tags"}},
+		{map[string]bigquery.Value{"id": 1, "tags": []interface{}{"a", 2}}, []string{"tags[1]"}},
+		{map[string]bigquery.Value{"id": 1, "address": map[string]bigquery.Value{"zip": "0150"}}, []string{"address.city", "address.zip"}},
+		{map[string]bigquery.Value{"id": 1, "amount": big.NewRat(1, 3)}, []string{"amount"}},
+		{map[string]bigquery.Value{"id": 1, "amount": new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(30), nil))}, []string{"amount"}},
+		{map[string]bigquery.Value{"id": "1"}, []string{"id"}},
+	}
+	for _, tt := range tests {
+		err := Validate(schema, tt.row)
+		verr, ok := err.(*ValidationError)
+		if !ok {
+			t.Errorf("expected %v to be invalid, got %v", tt.row, err)
+			continue
+		}
+		var fields []string
+		for _, fe := range verr.Errors {
+			fields = append(fields, fe.Field)
+		}
+		if !reflect.DeepEqual(fields, tt.want) {
+			t.Errorf("expected errors for %v, got %v", tt.want, verr)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ViewOperations is the view-capable extension of TableOperations, needed by streams with view swaps. The table
+// operations used by default implement it.
+type ViewOperations interface {
+	// ViewTarget returns the table that the view selects from, or nil if the view does not exist.
+	ViewTarget(ctx context.Context, view *bigquery.Table) (*bigquery.Table, error)
+
+	// PointView creates the view, or atomically updates it if it exists, to select all rows of the target table.
+	PointView(ctx context.Context, view, target *bigquery.Table) error
+
+	// ExpireTable sets the time at which BigQuery deletes the table.
+	ExpireTable(ctx context.Context, table *bigquery.Table, expiration time.Time) error
+}
+
+// errViewsUnsupported is returned when a stream has view swaps but the table operations cannot manage views.
+var errViewsUnsupported = errors.New("table operations do not implement ViewOperations")
+
+const defaultGracePeriod = time.Hour
+
+// ViewSwapOptions configures how a truncate stream swaps the table version behind its view.
+type ViewSwapOptions struct {
+	// GracePeriod is how long the table version that a view selected from before a swap is kept, so that queries
+	// running during the swap can finish. Defaults to one hour.
+	GracePeriod time.Duration
+
+	// RejectedRetention is how long table versions rejected by a truncate guard or assertions are kept for inspection
+	// before BigQuery deletes them. Defaults to the grace period.
+	RejectedRetention time.Duration
+}
+
+// WithViewSwap makes a truncate stream write each iteration to a new table version, named after the target table and
+// the time the iteration was first flushed, such as readings_v20211103140509000000000. When the iteration completes, a view
+// with the name of the target table is created, or updated, to select from the new version, and the previous version
+// is deleted by BigQuery once the grace period has passed. Consumers querying the view thus never see a partially
+// written table. A table with the name of the target table must not already exist.
+//
+// Versions rejected by a truncate guard or assertions are kept for inspection until the rejected retention has passed.
+// Snapshots are not taken for streams with view swaps, since the previous version remains available throughout the
+// grace period. View swaps are not used for streams using the LoadJob write method.
+func WithViewSwap(opts ViewSwapOptions) StreamOption {
+	return func(collector *streamOptionsCollector) {
+		if opts.GracePeriod <= 0 {
+			opts.GracePeriod = defaultGracePeriod
+		}
+		if opts.RejectedRetention <= 0 {
+			opts.RejectedRetention = opts.GracePeriod
+		}
+		collector.viewSwap = &opts
+	}
+}
+
+// versionSchema returns the schema of the version of the target table that an iteration started at the given time
+// writes to.
+func versionSchema(s Schema, t time.Time) Schema {
+	md := *s.BQSchema
+	md.Name = fmt.Sprintf("%s_v%s%09d", s.BQSchema.Name, t.Format("20060102150405"), t.Nanosecond())
+	s.BQSchema = &md
+	return s
+}
+
+var viewTargetPattern = regexp.MustCompile("^SELECT \\* FROM `([^`.]+)\\.([^`.]+)\\.([^`.]+)`$")
+
+// viewQuery returns the query of a view selecting all rows of the table.
+func viewQuery(table *bigquery.Table) string {
+	return fmt.Sprintf("SELECT * FROM `%s.%s.%s`", table.ProjectID, table.DatasetID, table.TableID)
+}
+
+// parseViewQuery returns the project, dataset and table selected from by a view query created by viewQuery.
+func parseViewQuery(query string) (string, string, string, error) {
+	m := viewTargetPattern.FindStringSubmatch(strings.TrimSpace(query))
+	if m == nil {
+		return "", "", "", fmt.Errorf("view query %q was not created by this package", query)
+	}
+	return m[1], m[2], m[3], nil
+}
+
+// writeSwap writes the iteration to a new version of the target table and, when the iteration is done, points the
+// view named after the target table to it.
+func (s *streamHandler) writeSwap(ctx context.Context, d *destination, done bool) (string, error) {
+	if !d.previouslyFlushed {
+		version, err := s.operations.CreateTable(ctx, s.dataset, versionSchema(d.schema, time.Now().UTC()))
+		d.tempTable = version
+		d.tempCreated = time.Now()
+		if err != nil {
+			return "while creating table version", err
+		}
+	}
+
+	err := s.writeTemp(ctx, d)
+	if err != nil {
+		return "while writing to table version", err
+	}
+
+	if !done {
+		return "", nil
+	}
+
+	views, ok := s.operations.(ViewOperations)
+	if !ok {
+		return "while reading view", errViewsUnsupported
+	}
+
+	ctx, fence, release, err := s.acquireLease(ctx, d.schema)
+	if err != nil {
+		return "while acquiring lease", err
+	}
+	defer release()
+
+	err = s.checkEncryption(ctx, d.tempTable, d.schema)
+	if err != nil {
+		return "while verifying table encryption", err
+	}
+
+	view := s.operations.TableRef(s.dataset, d.schema)
+	previous, err := views.ViewTarget(ctx, view)
+	if err != nil {
+		return "while reading view", err
+	}
+
+	err = s.checkGuard(ctx, view, previous, d.tempTable, d.written)
+	if err != nil {
+		s.expireRejected(ctx, views, d, err)
+		return "while checking truncate guard", err
+	}
+
+	err = s.checkAssertions(ctx, d.tempTable)
+	if err != nil {
+		s.expireRejected(ctx, views, d, err)
+		return "while checking assertions", err
+	}
+
+	err = fence()
+	if err != nil {
+		return "while renewing lease", err
+	}
+
+	err = views.PointView(ctx, view, d.tempTable)
+	if err != nil {
+		return "while pointing view to table version", fenced(ctx, fence, err)
+	}
+	s.logger.Info("view swapped to table version",
+		"stream", s.stream.Type(),
+		"view", view.TableID,
+		"table", d.tempTable.TableID)
+
+	if previous == nil || previous.TableID == d.tempTable.TableID {
+		return "", nil
+	}
+	err = views.ExpireTable(ctx, previous, time.Now().Add(s.stream.opts.viewSwap.GracePeriod))
+	if err != nil {
+		return "while expiring previous table version", err
+	}
+	return "", nil
+}
+
+// expireRejected sets the table version of the destination to expire after the rejected retention if err rejects the
+// iteration. A failure to expire is only logged, since the rejection is reported.
+func (s *streamHandler) expireRejected(ctx context.Context, views ViewOperations, d *destination, err error) {
+	if !rejected(err) {
+		return
+	}
+	expiration := time.Now().Add(s.stream.opts.viewSwap.RejectedRetention)
+	if err := views.ExpireTable(ctx, d.tempTable, expiration); err != nil {
+		s.logger.Warn("failed to expire rejected table version",
+			"stream", s.stream.Type(),
+			"table", d.tempTable.TableID,
+			"error", err)
+	}
+}
@@ -0,0 +1,35 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"testing"
+	"time"
+)
+
+func Test_parseViewQuery(t *testing.T) {
+	query := viewQuery(&bigquery.Table{ProjectID: "my-project", DatasetID: "raw", TableID: "readings_v20211103140509000000000"})
+
+	project, dataset, table, err := parseViewQuery(query)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if project != "my-project" || dataset != "raw" || table != "readings_v20211103140509000000000" {
+		t.Errorf("unexpected target %s.%s.%s", project, dataset, table)
+	}
+
+	if _, _, _, err := parseViewQuery("SELECT * FROM `raw.readings` WHERE value > 0"); err == nil {
+		t.Error("expected a query not created by viewQuery to be rejected")
+	}
+}
+
+func Test_versionSchema(t *testing.T) {
+	s := Schema{BQSchema: &bigquery.TableMetadata{Name: "readings", Description: "Meter readings"}}
+	v := versionSchema(s, time.Date(2021, 11, 3, 14, 5, 9, 12000000, time.UTC))
+
+	if v.BQSchema.Name != "readings_v20211103140509012000000" {
+		t.Errorf("unexpected version name %s", v.BQSchema.Name)
+	}
+	if v.BQSchema.Description != "Meter readings" || s.BQSchema.Name != "readings" {
+		t.Error("expected the version to keep the metadata of the schema without changing it")
+	}
+}
@@ -0,0 +1,388 @@
+package sink
+
+import (
+	"bufio"
+	"cloud.google.com/go/bigquery"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SyncPolicy decides when the segment files of a write-ahead log are synced to disk.
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs the segment file after every append, so that Send only returns once the row is on disk.
+	SyncAlways SyncPolicy = iota
+
+	// SyncInterval syncs the segment file on append if it has not been synced within WALOptions.SyncInterval.
+	SyncInterval
+
+	// SyncNever leaves syncing to the operating system. Rows survive a crash of the process, but not of the host.
+	SyncNever
+)
+
+// WALOptions configures the write-ahead log of a stream.
+type WALOptions struct {
+	// Dir is the directory where segment files are written. Each stream must have its own directory.
+	Dir string
+
+	// SegmentSize is the size in bytes after which a new segment file is started. Defaults to 64 MiB.
+	SegmentSize int64
+
+	// Sync decides when segment files are synced to disk. Defaults to SyncAlways.
+	Sync SyncPolicy
+
+	// SyncInterval is the interval used with the SyncInterval policy.
+	SyncInterval time.Duration
+}
+
+const (
+	walKindRow      byte = 1
+	walKindComplete byte = 2
+
+	walHeaderSize         = 17
+	walDefaultSegmentSize = 64 << 20
+	walCommittedFile      = "committed"
+	walSegmentSuffix      = ".wal"
+
+	walRetryBackoff    = 100 * time.Millisecond
+	walMaxRetryBackoff = 30 * time.Second
+)
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// walEntry is a row that has been appended to the write-ahead log, carrying its sequence number to the handler.
+type walEntry struct {
+	*savedRow
+	seq uint64
+}
+
+// wal is a write-ahead log made up of segment files of records. Each record has a header consisting of the payload
+// length, a CRC-32C checksum, the sequence number and the record kind. The highest sequence number written to
+// BigQuery is kept in a separate file, and segments holding only committed records are deleted.
+type wal struct {
+	opts WALOptions
+	mux  *sync.Mutex
+
+	seq          uint64
+	committed    uint64
+	recovered    uint64
+	lastComplete uint64
+
+	active     *os.File
+	activeSize int64
+	lastSync   time.Time
+}
+
+func openWAL(opts WALOptions) (*wal, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = walDefaultSegmentSize
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	w := &wal{opts: opts, mux: &sync.Mutex{}}
+
+	committed, err := w.readCommitted()
+	if err != nil {
+		return nil, err
+	}
+	w.committed = committed
+
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	w.seq = committed
+	for _, seg := range segments {
+		last, _, err := readSegment(filepath.Join(opts.Dir, seg.name), nil)
+		if err != nil && last == 0 {
+			continue
+		}
+		if last > w.seq {
+			w.seq = last
+		}
+	}
+	w.recovered = w.seq
+	return w, nil
+}
+
+// append writes a record of the given kind and returns its sequence number.
+func (w *wal) append(kind byte, data []byte) (uint64, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.active == nil || w.activeSize >= w.opts.SegmentSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	seq := w.seq + 1
+	buf := make([]byte, walHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint64(buf[8:16], seq)
+	buf[16] = kind
+	copy(buf[walHeaderSize:], data)
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(buf[8:], walTable))
+
+	if _, err := w.active.Write(buf); err != nil {
+		w.discard()
+		return 0, err
+	}
+
+	if w.opts.Sync == SyncAlways || (w.opts.Sync == SyncInterval && time.Since(w.lastSync) >= w.opts.SyncInterval) {
+		if err := w.active.Sync(); err != nil {
+			w.discard()
+			return 0, err
+		}
+		w.lastSync = time.Now()
+	}
+	w.seq = seq
+	w.activeSize += int64(len(buf))
+	return seq, nil
+}
+
+// discard drops the record that failed to be appended to the active segment by truncating the segment to the records
+// before it. The segment is closed, so that the next append starts a new one rather than following a torn record if
+// the truncation failed as well.
+func (w *wal) discard() {
+	_ = w.active.Truncate(w.activeSize)
+	_ = w.active.Close()
+	w.active = nil
+}
+
+// walRecord saves the row and encodes it as the payload of a row record.
+func walRecord(schema bigquery.Schema, v bigquery.ValueSaver) (*savedRow, []byte, error) {
+	row, err := save(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := encodeSpooled(schema, row)
+	if err != nil {
+		return nil, nil, err
+	}
+	return row, b, nil
+}
+
+// appendRow encodes the row and appends it to the log.
+func (w *wal) appendRow(schema bigquery.Schema, v bigquery.ValueSaver) (*walEntry, error) {
+	row, b, err := walRecord(schema, v)
+	if err != nil {
+		return nil, err
+	}
+	return w.appendRecord(row, b)
+}
+
+// appendRecord appends a row record encoded by walRecord.
+func (w *wal) appendRecord(row *savedRow, b []byte) (*walEntry, error) {
+	seq, err := w.append(walKindRow, b)
+	if err != nil {
+		return nil, err
+	}
+	return &walEntry{savedRow: row, seq: seq}, nil
+}
+
+// appendComplete appends a marker for the completion of an iteration.
+func (w *wal) appendComplete() error {
+	seq, err := w.append(walKindComplete, nil)
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint64(&w.lastComplete, seq)
+	return nil
+}
+
+// committedSeq returns the highest sequence number that has been committed.
+func (w *wal) committedSeq() uint64 {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.committed
+}
+
+// completed returns the sequence number of the last completion marker.
+func (w *wal) completed() uint64 {
+	return atomic.LoadUint64(&w.lastComplete)
+}
+
+func (w *wal) rotate() error {
+	if w.active != nil {
+		if err := w.active.Sync(); err != nil {
+			return err
+		}
+		if err := w.active.Close(); err != nil {
+			return err
+		}
+	}
+	// A segment named after the next sequence number can only hold records that failed to be appended.
+	name := filepath.Join(w.opts.Dir, fmt.Sprintf("%020d%s", w.seq+1, walSegmentSuffix))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	w.active = f
+	w.activeSize = 0
+	return nil
+}
+
+// commit records that all records up to and including the given sequence number have been written to BigQuery, and
+// deletes the segments that hold only committed records.
+func (w *wal) commit(upTo uint64) error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if upTo <= w.committed {
+		return nil
+	}
+
+	tmp := filepath.Join(w.opts.Dir, walCommittedFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(upTo, 10)), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(w.opts.Dir, walCommittedFile)); err != nil {
+		return err
+	}
+	w.committed = upTo
+
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for i, seg := range segments {
+		if i == len(segments)-1 {
+			break
+		}
+		if segments[i+1].first-1 > upTo {
+			break
+		}
+		if err := os.Remove(filepath.Join(w.opts.Dir, seg.name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replay calls fn for every record that was in the log when it was opened and has not been committed. Corrupt
+// records end the replay of their segment and are reported in the returned error.
+func (w *wal) replay(fn func(kind byte, seq uint64, data []byte) error) error {
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	var corrupt []string
+	for _, seg := range segments {
+		if seg.first > w.recovered {
+			break
+		}
+		_, _, err := readSegment(filepath.Join(w.opts.Dir, seg.name), func(kind byte, seq uint64, data []byte) error {
+			if seq <= w.committed || seq > w.recovered {
+				return nil
+			}
+			return fn(kind, seq, data)
+		})
+		if errors.Is(err, errCorruptRecord) {
+			corrupt = append(corrupt, err.Error())
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(corrupt) > 0 {
+		return errors.New(strings.Join(corrupt, "; "))
+	}
+	return nil
+}
+
+var errCorruptRecord = errors.New("corrupt write-ahead log record")
+
+// readSegment reads the records of the segment file, calling fn for each if not nil. The sequence number of the last
+// valid record is returned together with the offset after it.
+func readSegment(name string, fn func(kind byte, seq uint64, data []byte) error) (uint64, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var last uint64
+	var offset int64
+	header := make([]byte, walHeaderSize)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			return last, offset, nil
+		}
+		if err != nil {
+			return last, offset, fmt.Errorf("%w in %s at offset %d: truncated header", errCorruptRecord, filepath.Base(name), offset)
+		}
+		n := binary.BigEndian.Uint32(header[0:4])
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return last, offset, fmt.Errorf("%w in %s at offset %d: truncated payload", errCorruptRecord, filepath.Base(name), offset)
+		}
+		crc := crc32.Update(crc32.Checksum(header[8:], walTable), walTable, data)
+		if crc != binary.BigEndian.Uint32(header[4:8]) {
+			return last, offset, fmt.Errorf("%w in %s at offset %d: checksum mismatch", errCorruptRecord, filepath.Base(name), offset)
+		}
+		seq := binary.BigEndian.Uint64(header[8:16])
+		if fn != nil {
+			if err := fn(header[16], seq, data); err != nil {
+				return last, offset, err
+			}
+		}
+		last = seq
+		offset += int64(walHeaderSize) + int64(n)
+	}
+}
+
+type walSegment struct {
+	name  string
+	first uint64
+}
+
+// segments returns the segment files of the log ordered by their first sequence number.
+func (w *wal) segments() ([]walSegment, error) {
+	entries, err := os.ReadDir(w.opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []walSegment
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), walSegmentSuffix) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), walSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, walSegment{name: e.Name(), first: first})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].first < segments[j].first
+	})
+	return segments, nil
+}
+
+func (w *wal) readCommitted() (uint64, error) {
+	b, err := os.ReadFile(filepath.Join(w.opts.Dir, walCommittedFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
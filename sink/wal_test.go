@@ -0,0 +1,152 @@
+package sink
+
+import (
+	"cloud.google.com/go/bigquery"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_wal_replay(t *testing.T) {
+	dir := t.TempDir()
+	schema := bigquery.Schema{{Name: "s", Type: bigquery.StringFieldType}}
+
+	w, err := openWAL(WALOptions{Dir: dir, SegmentSize: 64})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := w.appendRow(schema, &savedRow{row: map[string]bigquery.Value{"s": fmt.Sprintf("%d", i)}}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if err := w.appendComplete(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := w.commit(2); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	segments, _ := w.segments()
+	if len(segments) != 2 {
+		t.Errorf("unexpected number of segments after commit, got %d", len(segments))
+	}
+
+	w, err = openWAL(WALOptions{Dir: dir, SegmentSize: 64})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var got []string
+	err = w.replay(func(kind byte, seq uint64, data []byte) error {
+		if kind == walKindComplete {
+			got = append(got, "complete")
+			return nil
+		}
+		row, err := decodeSpooledRecord(schema, data)
+		if err != nil {
+			return err
+		}
+		got = append(got, fmt.Sprintf("%d:%v", seq, row.row["s"]))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if want := `[3:2 4:3 complete]`; fmt.Sprint(got) != want {
+		t.Errorf("unexpected replay, got %v, want %v", got, want)
+	}
+
+	// New appends continue the sequence of the recovered log.
+	if err := w.appendComplete(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if w.completed() != 6 {
+		t.Errorf("unexpected sequence number, got %d", w.completed())
+	}
+}
+
+func Test_wal_corruption(t *testing.T) {
+	dir := t.TempDir()
+	schema := bigquery.Schema{{Name: "s", Type: bigquery.StringFieldType}}
+
+	w, err := openWAL(WALOptions{Dir: dir, Sync: SyncNever})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := w.appendRow(schema, &savedRow{row: map[string]bigquery.Value{"s": "value"}}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	segments, _ := w.segments()
+	name := filepath.Join(dir, segments[0].name)
+	b, _ := os.ReadFile(name)
+	b[len(b)-2] ^= 0xff
+	if err := os.WriteFile(name, b, 0o644); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	w, err = openWAL(WALOptions{Dir: dir})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	count := 0
+	err = w.replay(func(kind byte, seq uint64, data []byte) error {
+		count++
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected checksum error, got %v", err)
+	}
+	if count != 2 {
+		t.Errorf("unexpected number of replayed records, got %d", count)
+	}
+}
+
+func Test_logged(t *testing.T) {
+	dir := t.TempDir()
+	schema := bigquery.Schema{{Name: "s", Type: bigquery.StringFieldType}}
+
+	w, err := openWAL(WALOptions{Dir: dir})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	s := &streamImpl{schema: Schema{BQSchema: &bigquery.TableMetadata{Schema: schema}}, wal: w, errs: make(chan error)}
+	s.logged(&savedRow{row: map[string]bigquery.Value{"s": "0"}})
+
+	// The append fails on the closed segment, and is retried in a new one.
+	_ = w.active.Close()
+	entries := make(chan *walEntry)
+	go func() {
+		entries <- s.logged(&savedRow{row: map[string]bigquery.Value{"s": "1"}}).(*walEntry)
+	}()
+	if err := <-s.errs; err == nil {
+		t.Fatal("expected the failed append to be reported")
+	}
+	if e := <-entries; e.seq != 2 {
+		t.Errorf("unexpected sequence number, got %d", e.seq)
+	}
+
+	w, err = openWAL(WALOptions{Dir: dir})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var got []string
+	err = w.replay(func(kind byte, seq uint64, data []byte) error {
+		row, err := decodeSpooledRecord(schema, data)
+		if err != nil {
+			return err
+		}
+		got = append(got, fmt.Sprintf("%d:%v", seq, row.row["s"]))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if want := `[1:0 2:1]`; fmt.Sprint(got) != want {
+		t.Errorf("unexpected replay, got %v, want %v", got, want)
+	}
+}
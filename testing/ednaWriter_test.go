@@ -2,10 +2,19 @@ package testing
 
 import (
 	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/3lvia/edna-writer-go/sink"
 	"github.com/3lvia/metrics-go/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"sync"
 	"testing"
@@ -51,7 +60,7 @@ func Test_Start_WriteAppend(t *testing.T) {
 		ctx,
 		sink.WithBigQuery(projectID, datasetID),
 		sink.WithTableOperations(ops),
-		sink.WithMetrics(m))
+		sink.WithMetrics(sink.MetricsGo(m, prometheus.NewRegistry())))
 
 	startProducer(sourceStream)
 
@@ -112,7 +121,7 @@ func Test_Start_WriteTruncate(t *testing.T) {
 		ctx,
 		sink.WithBigQuery(projectID, datasetID),
 		sink.WithTableOperations(ops),
-		sink.WithMetrics(m))
+		sink.WithMetrics(sink.MetricsGo(m, prometheus.NewRegistry())))
 
 	startProducer(sourceStream)
 
@@ -150,7 +159,6 @@ func Test_Start_WriteAppend_WithFlushing(t *testing.T) {
 	//gaugeChanges := make(chan metrics.GaugeChange)
 	//m := metrics.New(metrics.WithOutputChannels(countChanges, gaugeChanges))
 
-	m := metrics.New()
 	//
 	//wg := &sync.WaitGroup{}
 	//wg.Add(1)
@@ -181,7 +189,9 @@ func Test_Start_WriteAppend_WithFlushing(t *testing.T) {
 		ctx,
 		sink.WithBigQuery(projectID, datasetID),
 		sink.WithTableOperations(ops),
-		sink.WithMetrics(m))
+		// The stream shares its name with the one in Test_Start_WriteAppend, whose metrics-go counters are registered
+		// globally with the stream as a label, so the metrics of this test are kept in a registry of their own.
+		sink.WithMetrics(sink.PrometheusMetrics(prometheus.NewRegistry())))
 
 	startFlushingProducer(sourceStream)
 
@@ -208,124 +218,1856 @@ func Test_Start_WriteAppend_WithFlushing(t *testing.T) {
 	}
 }
 
-func startProducer(ss sink.SourceStream) {
+func Test_Start_DatasetOverride(t *testing.T) {
+	ctx := context.Background()
+
+	s := schema(bigquery.WriteAppend)
+	s.ProjectID = "other-project"
+	s.DatasetID = "domain_area_curated"
+	sourceStream := sink.Stream("test4", s)
+
+	done := make(chan struct{})
+	ops := &mockTableOperations{}
+	ops.setDoneChan(1, done)
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops))
+
+	startProducer(sourceStream)
+
+	<-done
+
+	if len(ops.datasetEnsures) != 1 {
+		t.Fatalf("unexpected number of dataset checks, got %d", len(ops.datasetEnsures))
+	}
+	if ops.datasetEnsures[0] != "other-project.domain_area_curated" {
+		t.Errorf("unexpected dataset checked, got %s", ops.datasetEnsures[0])
+	}
+
+	if len(ops.tableCreations) != 1 {
+		t.Fatalf("unexpected number of table creations, got %d", len(ops.tableCreations))
+	}
+	if tc := ops.tableCreations[0]; tc != "domain_area_curated.integration_test_truncate" {
+		t.Errorf("unexpected table created, got %s", tc)
+	}
+}
+
+func Test_Start_WithRouter(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream(
+		"test5",
+		schema(bigquery.WriteAppend),
+		sink.WithRouter(sink.KeyRouter("readings", "intColumn")))
+
+	done := make(chan struct{})
+	ops := &mockTableOperations{}
+	ops.setDoneChan(3, done)
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops))
+
+	startProducer(sourceStream)
+
+	<-done
+
+	if len(ops.rows) != 3 {
+		t.Errorf("unexpected number of rows written, got %d", len(ops.rows))
+	}
+
+	want := []string{"domain_area_raw.readings_0", "domain_area_raw.readings_1", "domain_area_raw.readings_2"}
+	if len(ops.tableCreations) != len(want) {
+		t.Fatalf("unexpected number of table creations, got %d", len(ops.tableCreations))
+	}
+	for i, tc := range ops.tableCreations {
+		if tc != want[i] {
+			t.Errorf("unexpected table created, got %s, want %s", tc, want[i])
+		}
+	}
+}
+
+func Test_Start_WriteTruncate_WithKMSKey(t *testing.T) {
+	ctx := context.Background()
+
+	const key = "projects/p/locations/europe-north1/keyRings/r/cryptoKeys/k"
+
+	sourceStream := sink.Stream("test6", schema(bigquery.WriteTruncate))
+
+	errChan := make(chan error)
+	ops := &mockTableOperations{
+		encryptionKeys: map[string]string{"domain_area_raw.integration_test_truncate": "projects/p/locations/europe-north1/keyRings/r/cryptoKeys/other"},
+	}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithKMSKeyName(key),
+		sink.WithErrorChannel(errChan))
+
+	startProducer(sourceStream)
+
+	err := <-errChan
+	if !strings.Contains(err.Error(), "while verifying table encryption") {
+		t.Errorf("unexpected error, got %v", err)
+	}
+
+	if len(ops.tableCreations) != 2 {
+		t.Fatalf("unexpected number of table creations, got %d", len(ops.tableCreations))
+	}
+	if k := ops.encryptionKeys[ops.tableCreations[0]]; k != key {
+		t.Errorf("unexpected key on temp table, got %s", k)
+	}
+
+	if len(ops.tableCopyOperations) != 0 {
+		t.Errorf("unexpected number of copy operations, got %d", len(ops.tableCopyOperations))
+	}
+}
+
+func Test_Start_WithDeduplication(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream(
+		"test7",
+		schema(bigquery.WriteAppend),
+		sink.WithInsertIDKeys("stringColumn", "intColumn"),
+		sink.WithDeduplication())
+
+	done := make(chan struct{})
+	ops := &mockTableOperations{}
+	ops.setDoneChan(1, done)
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops))
+
 	go func() {
 		for i := 0; i < 3; i++ {
-			r := &row{
-				s: fmt.Sprintf("%d", i),
-				i: i,
-				t: time.Now().UTC(),
-			}
-			ss.Send(r)
+			r := &row{s: fmt.Sprintf("%d", i), i: i, t: time.Now().UTC()}
+			sourceStream.Send(r)
+			sourceStream.Send(r)
 		}
-		ss.Complete()
+		sourceStream.Complete()
 	}()
+
+	<-done
+
+	if len(ops.rows) != 3 {
+		t.Fatalf("unexpected number of rows written, got %d", len(ops.rows))
+	}
+	ids := map[string]bool{}
+	for _, r := range ops.rows {
+		_, id, _ := r.Save()
+		if id == "" {
+			t.Error("expected insertID to be set")
+		}
+		ids[id] = true
+	}
+	if len(ids) != 3 {
+		t.Errorf("unexpected number of distinct insertIDs, got %d", len(ids))
+	}
 }
 
-func startFlushingProducer(ss sink.SourceStream) {
+func Test_Start_WriteTruncate_WithLoadJob(t *testing.T) {
+	ctx := context.Background()
+
+	s := schema(bigquery.WriteTruncate)
+	s.WriteMethod = sink.LoadJob
+	sourceStream := sink.Stream("test8", s, sink.WithLoadJobSpool(t.TempDir()))
+
+	done := make(chan struct{})
+	ops := &mockTableOperations{}
+	ops.setDoneChan(1, done)
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops))
+
 	go func() {
 		for i := 0; i < 3; i++ {
 			for j := 0; j < 3; j++ {
-				r := &row{
-					s: fmt.Sprintf("%d", i),
-					i: i,
-					t: time.Now().UTC(),
-				}
-				ss.Send(r)
+				sourceStream.Send(&row{s: fmt.Sprintf("%d", i), i: i, t: time.Now().UTC()})
 			}
-			ss.Flush()
+			sourceStream.Flush()
 		}
+		sourceStream.Complete()
 	}()
-}
 
-type row struct {
-	s string
-	i int
-	t time.Time
-}
+	<-done
 
-func (r *row) Save() (row map[string]bigquery.Value, insertID string, err error) {
-	m := map[string]bigquery.Value {
-		"stringColumn": r.s,
-		"intColumn": r.i,
-		"timeColumn": r.t,
+	if len(ops.rows) != 9 {
+		t.Errorf("unexpected number of rows loaded, got %d", len(ops.rows))
 	}
-	return m, "", nil
-}
 
-func schema(disposition bigquery.TableWriteDisposition) sink.Schema {
-	var s bigquery.Schema
-	s = append(s, &bigquery.FieldSchema{
-		Name: "stringColumn",
-		Description: "",
-		Required: false,
-		Type: bigquery.StringFieldType,
-	})
-	s = append(s, &bigquery.FieldSchema{
-		Name: "intColumn",
-		Description: "",
-		Required: false,
-		Type: bigquery.IntegerFieldType,
-	})
-	s = append(s, &bigquery.FieldSchema{
-		Name: "timeColumn",
-		Description: "",
-		Required: false,
-		Type: bigquery.TimeFieldType,
-	})
-	return sink.Schema{
-		BQSchema:         &bigquery.TableMetadata{
-			Name:        "integration_test_truncate",
-			Description: "Table for testing",
-			Schema:      s,
-		},
-		Disposition:      disposition,
+	if len(ops.loads) != 1 {
+		t.Fatalf("unexpected number of loads, got %d", len(ops.loads))
+	}
+	if l := ops.loads[0]; l != "domain_area_raw.integration_test_truncate WRITE_TRUNCATE" {
+		t.Errorf("unexpected load, got %s", l)
 	}
-}
 
-type mockTableOperations struct {
-	tableCreations      []string
-	tableCopyOperations []string
-	tableDeletions      []string
-	iterationCount      int
-	doneAfterWrites     int
-	doneChan            chan<- struct{}
-	rows                []bigquery.ValueSaver
+	if len(ops.tableCreations) != 1 {
+		t.Errorf("unexpected number of table creations, got %d", len(ops.tableCreations))
+	}
+	if len(ops.tableCopyOperations) != 0 {
+		t.Errorf("unexpected number of copy operations, got %d", len(ops.tableCopyOperations))
+	}
 }
 
-func (m *mockTableOperations) Write(ctx context.Context, table *bigquery.Table, rows []bigquery.ValueSaver) error {
-	for _, saver := range rows {
-		m.rows = append(m.rows, saver)
+func Test_Start_WriteTruncate_WithSpool(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream("test9", schema(bigquery.WriteTruncate), sink.WithSpool(t.TempDir(), 2))
+
+	done := make(chan struct{})
+	ops := &mockTableOperations{}
+	ops.setDoneChan(2, done)
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops))
+
+	startProducer(sourceStream)
+
+	<-done
+
+	if len(ops.rows) != 3 {
+		t.Errorf("unexpected number of rows written, got %d", len(ops.rows))
 	}
-	m.iterationCount = m.iterationCount + 1
-	if m.doneChan != nil && m.iterationCount >= m.doneAfterWrites {
-		m.doneChan <- struct{}{}
+	if ops.iterationCount != 2 {
+		t.Errorf("unexpected number of writes, got %d", ops.iterationCount)
 	}
-	return nil
 }
 
-func (m *mockTableOperations) CreateTable(ctx context.Context, dataset string, schema sink.Schema) (*bigquery.Table, error) {
-	m.tableCreations = append(m.tableCreations, fmt.Sprintf("%s.%s", dataset, schema.BQSchema.Name))
+func Test_Start_WriteAppend_WithWriteAheadLog(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
 
-	return m.TableRef(dataset, schema), nil
-}
+	failing := sink.Stream("test10", schema(bigquery.WriteAppend), sink.WithWriteAheadLog(sink.WALOptions{Dir: dir}))
 
-func (m *mockTableOperations) CopyTable(ctx context.Context, source, dest *bigquery.Table) error {
-	op := fmt.Sprintf("%s.%s -> %s.%s", source.DatasetID, source.TableID, dest.DatasetID, dest.TableID)
-	m.tableCopyOperations = append(m.tableCopyOperations, op)
-	return nil
-}
+	errChan := make(chan error)
+	ops := &mockTableOperations{writeErr: errors.New("unavailable")}
 
-func (m *mockTableOperations) DeleteTable(ctx context.Context, table *bigquery.Table) error {
-	m.tableDeletions = append(m.tableDeletions, fmt.Sprintf("%s.%s", table.DatasetID, table.TableID))
-	return nil
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithErrorChannel(errChan))
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			failing.Send(&row{s: fmt.Sprintf("%d", i), i: i, t: time.Now().UTC()})
+		}
+		failing.Flush()
+	}()
+
+	<-errChan
+
+	// A new stream on the same log replays the rows that were never written, as after a restart.
+	sink.Stream("test11", schema(bigquery.WriteAppend), sink.WithWriteAheadLog(sink.WALOptions{Dir: dir}))
+
+	done := make(chan struct{})
+	ops = &mockTableOperations{}
+	ops.setDoneChan(1, done)
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops))
+
+	<-done
+
+	if len(ops.rows) != 3 {
+		t.Errorf("unexpected number of rows replayed, got %d", len(ops.rows))
+	}
 }
 
-func (m *mockTableOperations) TableRef(dataset string, schema sink.Schema) *bigquery.Table {
-	return &bigquery.Table{DatasetID: dataset, TableID: schema.BQSchema.Name}
+func Test_Start_WriteAppend_WithWriteAheadLogReplayTyped(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	opts := []sink.StreamOption{
+		sink.WithWriteAheadLog(sink.WALOptions{Dir: dir}),
+		sink.WithValidation(sink.ValidationOptions{}),
+		sink.WithRouter(sink.KeyRouter("readings", "intColumn")),
+		sink.WithInsertIDKeys("stringColumn"),
+	}
+	failing := sink.Stream("test33", schema(bigquery.WriteAppend), opts...)
+
+	errChan := make(chan error, 10)
+	ops := &mockTableOperations{writeErr: errors.New("unavailable")}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithErrorChannel(errChan))
+
+	for i := 0; i < 3; i++ {
+		failing.Send(loadedRow{"stringColumn": fmt.Sprintf("%d", i), "intColumn": i, "timeColumn": civil.Time{Hour: i}})
+	}
+	failing.Flush()
+	<-errChan
+
+	// A new stream on the same log replays the rows that were never written, as after a restart.
+	sink.Stream("test34", schema(bigquery.WriteAppend), opts...)
+
+	replayErrChan := make(chan error, 10)
+	done := make(chan struct{}, 3)
+	ops = &mockTableOperations{}
+	ops.setDoneChan(3, done)
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithErrorChannel(replayErrChan))
+
+	<-done
+
+	select {
+	case err := <-replayErrChan:
+		t.Fatalf("expected the replayed rows to be valid, got %v", err)
+	default:
+	}
+	for i := 0; i < 3; i++ {
+		rows := ops.tableRows[fmt.Sprintf("domain_area_raw.readings_%d", i)]
+		if len(rows) != 1 {
+			t.Fatalf("expected a replayed row in readings_%d, got tables %v", i, ops.tableCreations)
+		}
+		row, insertID, _ := rows[0].Save()
+		if insertID == "" {
+			t.Errorf("expected an insertID on the replayed row")
+		}
+		if row["intColumn"] != int64(i) || row["timeColumn"] != (civil.Time{Hour: i}) {
+			t.Errorf("expected the replayed values to be typed, got %#v", row)
+		}
+	}
 }
 
-func (m *mockTableOperations) setDoneChan(doneAfter int, ch chan<- struct{}) {
-	m.doneChan = ch
-	m.doneAfterWrites = doneAfter
-}
\ No newline at end of file
+func Test_Start_WriteAppend_WithWriteAheadLogHeld(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	failing := sink.Stream("test41", schema(bigquery.WriteAppend), sink.WithWriteAheadLog(sink.WALOptions{Dir: dir}))
+
+	errChan := make(chan error, 10)
+	ops := &mockTableOperations{writeErr: errors.New("unavailable")}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithErrorChannel(errChan))
+
+	for i := 0; i < 3; i++ {
+		failing.Send(&row{s: fmt.Sprintf("%d", i), i: i, t: time.Now().UTC()})
+	}
+	failing.Flush()
+	<-errChan
+
+	// The rows of the next flush are written, but must not commit the log past the rows that failed.
+	ops.lock()
+	ops.writeErr = nil
+	ops.unlock()
+	for i := 3; i < 6; i++ {
+		failing.Send(&row{s: fmt.Sprintf("%d", i), i: i, t: time.Now().UTC()})
+	}
+	failing.Flush()
+	ops.await(func() bool { return len(ops.rows) == 3 })
+
+	// A new stream on the same log replays the rows from the failed flush on, as after a restart.
+	sink.Stream("test42", schema(bigquery.WriteAppend), sink.WithWriteAheadLog(sink.WALOptions{Dir: dir}))
+
+	done := make(chan struct{})
+	ops = &mockTableOperations{}
+	ops.setDoneChan(1, done)
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops))
+
+	<-done
+
+	if len(ops.rows) != 6 {
+		t.Fatalf("unexpected number of rows replayed, got %d", len(ops.rows))
+	}
+	if r, _, _ := ops.rows[0].Save(); r["stringColumn"] != "0" {
+		t.Errorf("expected the replay to start with the first failed row, got %v", r)
+	}
+}
+
+func Test_Start_WithIterationLedger(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream("test12", schema(bigquery.WriteAppend))
+
+	done := make(chan struct{})
+	ops := &mockTableOperations{}
+	ops.setDoneChan(3, done)
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithIterationLedger("sink_iterations", sink.LedgerSkip))
+
+	go func() {
+		for attempt := 0; attempt < 2; attempt++ {
+			sourceStream.(sink.IdentifiedStream).SetIterationID("2026-10-17")
+			for i := 0; i < 3; i++ {
+				sourceStream.Send(&row{s: fmt.Sprintf("%d", i), i: i, t: time.Now().UTC()})
+			}
+			sourceStream.Complete()
+		}
+	}()
+
+	<-done
+
+	if n := len(ops.tableRows["domain_area_raw.integration_test_truncate"]); n != 3 {
+		t.Errorf("unexpected number of rows written, got %d", n)
+	}
+
+	ledger := ops.tableRows["domain_area_raw.sink_iterations"]
+	if len(ledger) != 2 {
+		t.Fatalf("unexpected number of ledger entries, got %d", len(ledger))
+	}
+	for i, want := range []string{sink.IterationCommitted, sink.IterationSkipped} {
+		entry, _, _ := ledger[i].Save()
+		if entry["status"] != want || entry["iteration_id"] != "2026-10-17" || entry["stream"] != "test12" {
+			t.Errorf("unexpected ledger entry, got %v", entry)
+		}
+	}
+	entry, _, _ := ledger[0].Save()
+	if entry["rows"] != 3 {
+		t.Errorf("unexpected number of rows in ledger entry, got %v", entry["rows"])
+	}
+}
+
+func Test_Start_WithIterationLedgerQuery(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream("test35", schema(bigquery.WriteAppend))
+
+	ops := &mockTableOperations{tableRows: map[string][]bigquery.ValueSaver{
+		"domain_area_raw.sink_iterations": {
+			loadedRow{"stream": "test35", "iteration_id": "2026-10-18", "status": sink.IterationCommitted},
+			loadedRow{"stream": "other", "iteration_id": "2026-10-19", "status": sink.IterationCommitted},
+		},
+	}}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithIterationLedger("sink_iterations", sink.LedgerSkip),
+		sink.WithErrorChannel(make(chan error, 10)))
+
+	for _, id := range []string{"2026-10-18", "2026-10-19"} {
+		sourceStream.(sink.IdentifiedStream).SetIterationID(id)
+		sourceStream.Send(&row{s: id, i: 0, t: time.Now().UTC()})
+		sourceStream.Complete()
+	}
+	// Both iterations are recorded in the ledger, the first as skipped, when they have been handled.
+	ops.await(func() bool { return len(ops.tableRows["domain_area_raw.sink_iterations"]) == 4 })
+
+	if len(ops.queries) != 2 || !strings.Contains(ops.queries[0], "WHERE stream = @stream AND iteration_id = @iteration_id") {
+		t.Errorf("expected the ledger to be queried per iteration, got %v", ops.queries)
+	}
+	if n := len(ops.tableRows["domain_area_raw.integration_test_truncate"]); n != 1 {
+		t.Errorf("expected only the iteration committed by another stream to be written, got %d rows", n)
+	}
+}
+
+func Test_Start_WriteTruncate_WithMatchingKMSKey(t *testing.T) {
+	ctx := context.Background()
+
+	const key = "projects/p/locations/europe-north1/keyRings/r/cryptoKeys/k"
+
+	sourceStream := sink.Stream("test31", schema(bigquery.WriteTruncate))
+
+	ops := &mockTableOperations{
+		encryptionKeys: map[string]string{"domain_area_raw.integration_test_truncate": key},
+	}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithKMSKeyName(key),
+		sink.WithErrorChannel(make(chan error)))
+
+	startProducer(sourceStream)
+
+	// The temporary table is deleted once it has been copied to the target table.
+	ops.await(func() bool { return len(ops.tableDeletions) == 1 })
+
+	if len(ops.encryptedCopies) != 1 || ops.encryptedCopies[0] != "domain_area_raw.integration_test_truncate" {
+		t.Errorf("expected an encrypted copy to the target table, got %v", ops.encryptedCopies)
+	}
+}
+
+// baseOperations exposes only the methods of sink.TableOperations, hiding the optional extensions of the mock.
+type baseOperations struct {
+	sink.TableOperations
+}
+
+func Test_Start_WriteTruncate_WithBaseOperations(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream("test32", schema(bigquery.WriteTruncate))
+
+	ops := &mockTableOperations{}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(baseOperations{ops}),
+		sink.WithErrorChannel(make(chan error)))
+
+	startProducer(sourceStream)
+
+	// The temporary table is deleted once it has been copied to the target table.
+	ops.await(func() bool { return len(ops.tableDeletions) == 1 })
+
+	if len(ops.datasetEnsures) != 0 {
+		t.Errorf("expected no dataset checks without DatasetOperations, got %v", ops.datasetEnsures)
+	}
+	if len(ops.tableCopyOperations) != 1 || len(ops.encryptedCopies) != 0 {
+		t.Errorf("expected a plain copy to the target table, got %v", ops.tableCopyOperations)
+	}
+}
+
+func startProducer(ss sink.SourceStream) {
+	go func() {
+		for i := 0; i < 3; i++ {
+			r := &row{
+				s: fmt.Sprintf("%d", i),
+				i: i,
+				t: time.Now().UTC(),
+			}
+			ss.Send(r)
+		}
+		ss.Complete()
+	}()
+}
+
+func startFlushingProducer(ss sink.SourceStream) {
+	go func() {
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				r := &row{
+					s: fmt.Sprintf("%d", i),
+					i: i,
+					t: time.Now().UTC(),
+				}
+				ss.Send(r)
+			}
+			ss.Flush()
+		}
+	}()
+}
+
+type row struct {
+	s string
+	i int
+	t time.Time
+}
+
+func (r *row) Save() (row map[string]bigquery.Value, insertID string, err error) {
+	m := map[string]bigquery.Value {
+		"stringColumn": r.s,
+		"intColumn": r.i,
+		"timeColumn": r.t,
+	}
+	return m, "", nil
+}
+
+type loadedRow map[string]bigquery.Value
+
+func (r loadedRow) Save() (row map[string]bigquery.Value, insertID string, err error) {
+	return r, "", nil
+}
+
+func schema(disposition bigquery.TableWriteDisposition) sink.Schema {
+	var s bigquery.Schema
+	s = append(s, &bigquery.FieldSchema{
+		Name: "stringColumn",
+		Description: "",
+		Required: false,
+		Type: bigquery.StringFieldType,
+	})
+	s = append(s, &bigquery.FieldSchema{
+		Name: "intColumn",
+		Description: "",
+		Required: false,
+		Type: bigquery.IntegerFieldType,
+	})
+	s = append(s, &bigquery.FieldSchema{
+		Name: "timeColumn",
+		Description: "",
+		Required: false,
+		Type: bigquery.TimeFieldType,
+	})
+	return sink.Schema{
+		BQSchema:         &bigquery.TableMetadata{
+			Name:        "integration_test_truncate",
+			Description: "Table for testing",
+			Schema:      s,
+		},
+		Disposition:      disposition,
+	}
+}
+
+// mockTableOperations records the operations of the stream handlers. Its fields are guarded by mux, and tests read
+// them once await has seen the operations they expect.
+type mockTableOperations struct {
+	mux                 sync.Mutex
+	changed             *sync.Cond
+	tableCreations      []string
+	tableCopyOperations []string
+	encryptedCopies     []string
+	copiedRows          []int
+	tableDeletions      []string
+	datasetEnsures      []string
+	loads               []string
+	writeErr            error
+	tableRows           map[string][]bigquery.ValueSaver
+	encryptionKeys      map[string]string
+	numRows             map[string]uint64
+	violations          map[string]int64
+	queries             []string
+	snapshots           []string
+	restores            []string
+	views               map[string]string
+	expirations         []string
+	iterationCount      int
+	doneAfterWrites     int
+	doneChan            chan<- struct{}
+	rows                []bigquery.ValueSaver
+}
+
+// lock locks the mock, to be unlocked with unlock, which notifies await of the operation.
+func (m *mockTableOperations) lock() {
+	m.mux.Lock()
+	if m.changed == nil {
+		m.changed = sync.NewCond(&m.mux)
+	}
+}
+
+func (m *mockTableOperations) unlock() {
+	m.changed.Broadcast()
+	m.mux.Unlock()
+}
+
+// await blocks until cond returns true. It is called with the mock locked, initially and after every operation.
+func (m *mockTableOperations) await(cond func() bool) {
+	m.lock()
+	defer m.mux.Unlock()
+	for !cond() {
+		m.changed.Wait()
+	}
+}
+
+// signal sends on the done channel once the number of writes set with setDoneChan has been reached. It is called
+// with the mock unlocked, so that tests may await other operations while the handler is blocked sending.
+func (m *mockTableOperations) signal(writes int) {
+	m.mux.Lock()
+	done, ch := writes >= m.doneAfterWrites, m.doneChan
+	m.mux.Unlock()
+	if ch != nil && done {
+		ch <- struct{}{}
+	}
+}
+
+func (m *mockTableOperations) Write(ctx context.Context, table *bigquery.Table, rows []bigquery.ValueSaver) error {
+	m.lock()
+	if m.writeErr != nil {
+		m.unlock()
+		return m.writeErr
+	}
+	if m.tableRows == nil {
+		m.tableRows = map[string][]bigquery.ValueSaver{}
+	}
+	name := fmt.Sprintf("%s.%s", table.DatasetID, table.TableID)
+	m.tableRows[name] = append(m.tableRows[name], rows...)
+	for _, saver := range rows {
+		m.rows = append(m.rows, saver)
+	}
+	m.iterationCount = m.iterationCount + 1
+	writes := m.iterationCount
+	m.unlock()
+	m.signal(writes)
+	return nil
+}
+
+func (m *mockTableOperations) CreateTable(ctx context.Context, dataset string, schema sink.Schema) (*bigquery.Table, error) {
+	m.lock()
+	defer m.unlock()
+	name := fmt.Sprintf("%s.%s", dataset, schema.BQSchema.Name)
+	m.tableCreations = append(m.tableCreations, name)
+	if m.encryptionKeys == nil {
+		m.encryptionKeys = map[string]string{}
+	}
+	if _, ok := m.encryptionKeys[name]; !ok {
+		m.encryptionKeys[name] = schema.KMSKeyName
+	}
+
+	return m.TableRef(dataset, schema), nil
+}
+
+func (m *mockTableOperations) CopyTable(ctx context.Context, source, dest *bigquery.Table) error {
+	m.lock()
+	defer m.unlock()
+	op := fmt.Sprintf("%s.%s -> %s.%s", source.DatasetID, source.TableID, dest.DatasetID, dest.TableID)
+	m.tableCopyOperations = append(m.tableCopyOperations, op)
+	m.copiedRows = append(m.copiedRows, len(m.tableRows[fmt.Sprintf("%s.%s", source.DatasetID, source.TableID)]))
+	return nil
+}
+
+func (m *mockTableOperations) CopyTableEncrypted(ctx context.Context, source, dest *bigquery.Table, encryption *bigquery.EncryptionConfig) error {
+	m.lock()
+	m.encryptedCopies = append(m.encryptedCopies, fmt.Sprintf("%s.%s", dest.DatasetID, dest.TableID))
+	m.unlock()
+	return m.CopyTable(ctx, source, dest)
+}
+
+func (m *mockTableOperations) DeleteTable(ctx context.Context, table *bigquery.Table) error {
+	m.lock()
+	defer m.unlock()
+	name := fmt.Sprintf("%s.%s", table.DatasetID, table.TableID)
+	m.tableDeletions = append(m.tableDeletions, name)
+	delete(m.tableRows, name)
+	return nil
+}
+
+func (m *mockTableOperations) TableRef(dataset string, schema sink.Schema) *bigquery.Table {
+	return &bigquery.Table{DatasetID: dataset, TableID: schema.BQSchema.Name}
+}
+
+func (m *mockTableOperations) EnsureDataset(ctx context.Context, projectID, datasetID string, create *sink.DatasetOptions) error {
+	m.lock()
+	defer m.unlock()
+	m.datasetEnsures = append(m.datasetEnsures, fmt.Sprintf("%s.%s", projectID, datasetID))
+	return nil
+}
+
+func (m *mockTableOperations) Load(ctx context.Context, table *bigquery.Table, source io.Reader, schema sink.Schema, disposition bigquery.TableWriteDisposition) error {
+	m.lock()
+	m.loads = append(m.loads, fmt.Sprintf("%s.%s %s", table.DatasetID, table.TableID, disposition))
+	dec := json.NewDecoder(source)
+	for dec.More() {
+		r := loadedRow{}
+		if err := dec.Decode(&r); err != nil {
+			m.unlock()
+			return err
+		}
+		m.rows = append(m.rows, r)
+	}
+	m.iterationCount = m.iterationCount + 1
+	writes := m.iterationCount
+	m.unlock()
+	m.signal(writes)
+	return nil
+}
+
+// Query returns the number of violations configured for the first assertion name found in the SQL. Queries with
+// parameters return the rows of the table in the SQL whose columns equal the parameters of the same name.
+func (m *mockTableOperations) Query(ctx context.Context, projectID, sql string, params ...bigquery.QueryParameter) ([]map[string]bigquery.Value, error) {
+	m.lock()
+	defer m.unlock()
+	m.queries = append(m.queries, sql)
+	if len(params) > 0 {
+		var rows []map[string]bigquery.Value
+		for name, savers := range m.tableRows {
+			if !strings.Contains(sql, name+"`") {
+				continue
+			}
+			for _, saver := range savers {
+				row, _, _ := saver.Save()
+				match := true
+				for _, p := range params {
+					match = match && row[p.Name] == p.Value
+				}
+				if match {
+					rows = append(rows, row)
+				}
+			}
+		}
+		return rows, nil
+	}
+	for column, n := range m.violations {
+		if strings.Contains(sql, "`"+column+"`") {
+			return []map[string]bigquery.Value{{"violations": n}}, nil
+		}
+	}
+	return []map[string]bigquery.Value{{"violations": int64(0)}}, nil
+}
+
+func (m *mockTableOperations) Snapshot(ctx context.Context, source, snapshot *bigquery.Table, expiration time.Time) error {
+	m.lock()
+	defer m.unlock()
+	m.snapshots = append(m.snapshots, fmt.Sprintf("%s.%s", snapshot.DatasetID, snapshot.TableID))
+	return nil
+}
+
+func (m *mockTableOperations) Restore(ctx context.Context, snapshot, dest *bigquery.Table, encryption *bigquery.EncryptionConfig) error {
+	m.lock()
+	defer m.unlock()
+	op := fmt.Sprintf("%s.%s -> %s.%s", snapshot.DatasetID, snapshot.TableID, dest.DatasetID, dest.TableID)
+	m.restores = append(m.restores, op)
+	return nil
+}
+
+func (m *mockTableOperations) ListTables(ctx context.Context, projectID, datasetID, prefix string) ([]*bigquery.Table, error) {
+	m.lock()
+	defer m.unlock()
+	var tables []*bigquery.Table
+	for _, name := range m.snapshots {
+		parts := strings.SplitN(name, ".", 2)
+		if parts[0] == datasetID && strings.HasPrefix(parts[1], prefix) {
+			tables = append(tables, &bigquery.Table{DatasetID: parts[0], TableID: parts[1]})
+		}
+	}
+	return tables, nil
+}
+
+func (m *mockTableOperations) ViewTarget(ctx context.Context, view *bigquery.Table) (*bigquery.Table, error) {
+	m.lock()
+	defer m.unlock()
+	target, ok := m.views[fmt.Sprintf("%s.%s", view.DatasetID, view.TableID)]
+	if !ok {
+		return nil, nil
+	}
+	parts := strings.SplitN(target, ".", 2)
+	return &bigquery.Table{DatasetID: parts[0], TableID: parts[1]}, nil
+}
+
+func (m *mockTableOperations) PointView(ctx context.Context, view, target *bigquery.Table) error {
+	m.lock()
+	defer m.unlock()
+	if m.views == nil {
+		m.views = map[string]string{}
+	}
+	m.views[fmt.Sprintf("%s.%s", view.DatasetID, view.TableID)] = fmt.Sprintf("%s.%s", target.DatasetID, target.TableID)
+	return nil
+}
+
+func (m *mockTableOperations) ExpireTable(ctx context.Context, table *bigquery.Table, expiration time.Time) error {
+	m.lock()
+	defer m.unlock()
+	m.expirations = append(m.expirations, fmt.Sprintf("%s.%s", table.DatasetID, table.TableID))
+	return nil
+}
+
+func (m *mockTableOperations) Metadata(ctx context.Context, table *bigquery.Table) (*bigquery.TableMetadata, error) {
+	m.lock()
+	defer m.unlock()
+	md := &bigquery.TableMetadata{Name: table.TableID, NumRows: m.numRows[fmt.Sprintf("%s.%s", table.DatasetID, table.TableID)]}
+	if key := m.encryptionKeys[fmt.Sprintf("%s.%s", table.DatasetID, table.TableID)]; key != "" {
+		md.EncryptionConfig = &bigquery.EncryptionConfig{KMSKeyName: key}
+	}
+	return md, nil
+}
+
+func (m *mockTableOperations) setDoneChan(doneAfter int, ch chan<- struct{}) {
+	m.lock()
+	defer m.unlock()
+	m.doneChan = ch
+	m.doneAfterWrites = doneAfter
+}
+func Test_Start_WriteTruncate_WithTracing(t *testing.T) {
+	ctx := context.Background()
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	sourceStream := sink.Stream("test13", schema(bigquery.WriteTruncate))
+
+	ops := &mockTableOperations{}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithTracerProvider(tp))
+
+	producerCtx, producer := tp.Tracer("producer").Start(ctx, "produce")
+	for i := 0; i < 3; i++ {
+		sourceStream.(sink.ContextStream).SendContext(producerCtx, &row{s: fmt.Sprintf("%d", i), i: i, t: time.Now().UTC()})
+	}
+	sourceStream.(sink.ContextStream).CompleteContext(producerCtx)
+	producer.End()
+
+	// The handler picks up the flush only once the completion has ended.
+	sourceStream.Flush()
+
+	var complete sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "sink.complete" {
+			complete = span
+		}
+	}
+	if complete == nil {
+		t.Fatal("expected a span for the completion")
+	}
+	if links := complete.Links(); len(links) != 1 || links[0].SpanContext.SpanID() != producer.SpanContext().SpanID() {
+		t.Errorf("expected a link to the producer span, got %v", links)
+	}
+
+	var children []string
+	for _, span := range recorder.Ended() {
+		if span.Parent().SpanID() == complete.SpanContext().SpanID() {
+			children = append(children, span.Name())
+		}
+	}
+	want := []string{"bigquery.create_table", "bigquery.write", "bigquery.create_table", "bigquery.copy_table", "bigquery.delete_table"}
+	if strings.Join(children, ",") != strings.Join(want, ",") {
+		t.Errorf("unexpected child spans, got %v", children)
+	}
+
+	for _, kv := range complete.Attributes() {
+		if kv.Key == "sink.rows" && kv.Value.AsInt64() != 3 {
+			t.Errorf("unexpected number of rows, got %d", kv.Value.AsInt64())
+		}
+	}
+}
+
+func Test_Start_WriteAppend_WithLogger(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream("test14", schema(bigquery.WriteAppend))
+
+	logger := &recordingLogger{}
+	ops := &mockTableOperations{}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithLogger(logger))
+
+	for i := 0; i < 3; i++ {
+		sourceStream.Send(&row{s: fmt.Sprintf("%d", i), i: i, t: time.Now().UTC()})
+	}
+	sourceStream.Complete()
+
+	// The handler picks up the flush only once the completion has been logged.
+	sourceStream.Flush()
+
+	entry := logger.find("iteration done written")
+	if entry == nil {
+		t.Fatal("expected the completion to be logged")
+	}
+	if entry.level != "info" || entry.fields["stream"] != "test14" || entry.fields["rows"] != 3 || entry.fields["ok"] != true {
+		t.Errorf("unexpected log entry, got %v", entry)
+	}
+}
+
+type logEntry struct {
+	level  string
+	msg    string
+	fields map[string]interface{}
+}
+
+type recordingLogger struct {
+	mux     sync.Mutex
+	entries []*logEntry
+}
+
+func (l *recordingLogger) log(level, msg string, args []interface{}) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	e := &logEntry{level: level, msg: msg, fields: map[string]interface{}{}}
+	for i := 0; i+1 < len(args); i += 2 {
+		e.fields[fmt.Sprint(args[i])] = args[i+1]
+	}
+	l.entries = append(l.entries, e)
+}
+
+func (l *recordingLogger) find(msg string) *logEntry {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for _, e := range l.entries {
+		if e.msg == msg {
+			return e
+		}
+	}
+	return nil
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.log("debug", msg, args) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.log("info", msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.log("warn", msg, args) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.log("error", msg, args) }
+
+func Test_Start_WriteAppend_WithoutMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream("test15", schema(bigquery.WriteAppend))
+
+	done := make(chan struct{})
+	ops := &mockTableOperations{}
+	ops.setDoneChan(1, done)
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops))
+
+	startProducer(sourceStream)
+
+	<-done
+
+	if len(ops.rows) != 3 {
+		t.Errorf("unexpected number of rows written, got %d", len(ops.rows))
+	}
+}
+
+func Test_Start_WriteAppend_Health(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream("test16", schema(bigquery.WriteAppend))
+
+	errChan := make(chan error)
+	ops := &mockTableOperations{writeErr: errors.New("boom")}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithErrorChannel(errChan))
+
+	startProducer(sourceStream)
+	<-errChan
+
+	// The handler picks up the flush only once the completion has been recorded.
+	go sourceStream.Flush()
+	<-errChan
+
+	var health *sink.StreamHealth
+	for _, h := range sink.Health() {
+		if h.Stream == "test16" {
+			h := h
+			health = &h
+		}
+	}
+	if health == nil {
+		t.Fatal("expected health of the stream")
+	}
+	if !health.Started || health.ConsecutiveFailures < 1 || !health.LastFlush.IsZero() {
+		t.Errorf("unexpected health, got %+v", health)
+	}
+
+	rec := httptest.NewRecorder()
+	sink.ReadinessHandler(sink.HealthThresholds{MaxConsecutiveFailures: 1}).ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), `"stream":"test16"`) {
+		t.Errorf("expected the stream in the report, got %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	sink.LivenessHandler(sink.HealthThresholds{MaxStepDuration: time.Minute}).ServeHTTP(rec, httptest.NewRequest("GET", "/live", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("unexpected status, got %d", rec.Code)
+	}
+}
+
+func Test_Start_WriteTruncate_WithErrorHandler(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream("test17", schema(bigquery.WriteTruncate))
+
+	events := make(chan *sink.ErrorEvent, 10)
+	ops := &mockTableOperations{writeErr: errors.New("boom")}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		// The channel is never read, which must not stall the error handler or the stream.
+		sink.WithErrorChannel(make(chan error)),
+		sink.WithErrorQueue(sink.ErrorQueueOptions{Size: 1}),
+		sink.WithErrorHandler(func(e *sink.ErrorEvent) {
+			events <- e
+		}))
+
+	startProducer(sourceStream)
+
+	e := <-events
+	if e.Stream != "test17" || e.Step != "writing_to_temporary_table" || e.Table != "integration_test_truncate" || e.Rows != 3 {
+		t.Errorf("unexpected error event, got %+v", e)
+	}
+	if e.IterationID == "" || e.Retryable || e.Err.Error() != "boom" {
+		t.Errorf("unexpected error event, got %+v", e)
+	}
+
+	// The stream keeps going although events are dropped.
+	startProducer(sourceStream)
+	sourceStream.Flush()
+}
+
+func Test_Start_WriteTruncate_WithTruncateGuard(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		stream string
+		guard  sink.TruncateGuard
+		rows   int
+		want   string
+	}{
+		{"test18", sink.TruncateGuard{MinRows: 1}, 0, sink.GuardMinRows},
+		{"test19", sink.TruncateGuard{MaxShrinkRatio: 0.5}, 3, sink.GuardMaxShrink},
+		{"test20", sink.TruncateGuard{Check: func(ctx context.Context, info sink.GuardInfo) error {
+			if info.TempTable == nil || info.TargetRows != 100 {
+				return nil
+			}
+			return errors.New("rejected")
+		}}, 3, sink.GuardPredicate},
+	}
+	for _, tt := range tests {
+		sourceStream := sink.Stream(tt.stream, schema(bigquery.WriteTruncate), sink.WithTruncateGuard(tt.guard))
+
+		errChan := make(chan error)
+		ops := &mockTableOperations{numRows: map[string]uint64{"domain_area_raw.integration_test_truncate": 100}}
+
+		sink.Start(
+			ctx,
+			sink.WithBigQuery(projectID, datasetID),
+			sink.WithTableOperations(ops),
+			sink.WithErrorChannel(errChan))
+
+		go func(ss sink.SourceStream, rows int) {
+			for i := 0; i < rows; i++ {
+				ss.Send(&row{s: fmt.Sprintf("%d", i), i: i, t: time.Now().UTC()})
+			}
+			ss.Complete()
+		}(sourceStream, tt.rows)
+
+		err := <-errChan
+		var guardErr *sink.GuardError
+		if !errors.As(err, &guardErr) || guardErr.Guard != tt.want {
+			t.Errorf("%s: expected guard %s to trip, got %v", tt.stream, tt.want, err)
+			continue
+		}
+		if guardErr.Info.Rows != tt.rows {
+			t.Errorf("%s: unexpected number of rows, got %d", tt.stream, guardErr.Info.Rows)
+		}
+
+		if len(ops.tableCopyOperations) != 0 {
+			t.Errorf("%s: expected the target table to be left unchanged, got %v", tt.stream, ops.tableCopyOperations)
+		}
+		if len(ops.tableDeletions) != 0 {
+			t.Errorf("%s: expected the temporary table to be kept, got %v", tt.stream, ops.tableDeletions)
+		}
+	}
+}
+
+func Test_Start_WriteTruncate_WithTruncateGuardRetry(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream("test37", schema(bigquery.WriteTruncate), sink.WithTruncateGuard(sink.TruncateGuard{MinRows: 3}))
+
+	errChan := make(chan error, 1)
+	ops := &mockTableOperations{}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithErrorChannel(errChan))
+
+	// The rejected iteration is retried at once, within the same minute.
+	for _, rows := range []int{1, 3} {
+		for i := 0; i < rows; i++ {
+			sourceStream.Send(&row{s: fmt.Sprintf("%d", i), i: i, t: time.Now().UTC()})
+		}
+		sourceStream.Complete()
+	}
+
+	var guardErr *sink.GuardError
+	if err := <-errChan; !errors.As(err, &guardErr) {
+		t.Fatalf("expected the first iteration to be rejected, got %v", err)
+	}
+	// The temporary table of the retry is deleted once it has been copied to the target table.
+	ops.await(func() bool { return len(ops.tableDeletions) == 1 })
+	if len(ops.tableCreations) < 3 || ops.tableCreations[0] == ops.tableCreations[2] {
+		t.Fatalf("expected a new temporary table for the retry, got %v", ops.tableCreations)
+	}
+	for _, table := range ops.tableDeletions {
+		if table == ops.tableCreations[0] {
+			t.Errorf("expected the rejected temporary table to be kept, got %v", ops.tableDeletions)
+		}
+	}
+	if len(ops.copiedRows) != 1 || ops.copiedRows[0] != 3 {
+		t.Errorf("expected only the rows of the retry to be copied, got %v", ops.copiedRows)
+	}
+}
+
+func Test_Start_WriteTruncate_WithAssertions(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream("test21", schema(bigquery.WriteTruncate),
+		sink.WithAssertions(sink.AssertNotNull("stringColumn"), sink.AssertUnique("intColumn")))
+
+	errChan := make(chan error)
+	ops := &mockTableOperations{violations: map[string]int64{"intColumn": 2}}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithErrorChannel(errChan))
+
+	startProducer(sourceStream)
+
+	err := <-errChan
+	var assertionErr *sink.AssertionError
+	if !errors.As(err, &assertionErr) {
+		t.Fatalf("expected assertions to fail, got %v", err)
+	}
+	if len(assertionErr.Failed) != 1 || assertionErr.Failed[0].Name != "unique_intColumn" || assertionErr.Failed[0].Violations != 2 {
+		t.Errorf("unexpected failed assertions, got %v", assertionErr.Failed)
+	}
+
+	if len(ops.queries) != 2 {
+		t.Errorf("unexpected number of queries, got %d", len(ops.queries))
+	}
+	if len(ops.tableCopyOperations) != 0 {
+		t.Errorf("expected the target table to be left unchanged, got %v", ops.tableCopyOperations)
+	}
+	if len(ops.tableDeletions) != 0 {
+		t.Errorf("expected the temporary table to be kept, got %v", ops.tableDeletions)
+	}
+}
+
+func Test_Start_WriteTruncate_WithSnapshots(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream("test22", schema(bigquery.WriteTruncate),
+		sink.WithSnapshots(sink.SnapshotOptions{Retention: 24 * time.Hour, DatasetID: "backups"}))
+
+	ops := &mockTableOperations{numRows: map[string]uint64{"domain_area_raw.integration_test_truncate": 100}}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithErrorChannel(make(chan error)))
+
+	startProducer(sourceStream)
+
+	// The temporary table is deleted once it has been copied to the target table.
+	ops.await(func() bool { return len(ops.tableDeletions) == 1 })
+
+	if len(ops.snapshots) != 1 || !strings.HasPrefix(ops.snapshots[0], "backups.integration_test_truncate_snapshot_") {
+		t.Fatalf("expected a snapshot of the target table, got %v", ops.snapshots)
+	}
+	if len(ops.tableCopyOperations) != 1 {
+		t.Errorf("expected the target table to be replaced, got %v", ops.tableCopyOperations)
+	}
+
+	// Snapshots of other tables sharing the prefix of the target table are not listed.
+	ops.lock()
+	ops.snapshots = append(ops.snapshots,
+		"backups.integration_test_truncate_daily_snapshot_20211103_140509",
+		"backups.integration_test_truncate_snapshot_x_snapshot_20211103_140509",
+		"backups.integration_test_truncate_snapshot_2021")
+	ops.unlock()
+
+	snapshots, err := sink.Snapshots(ctx, "test22")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(snapshots) != 1 || snapshots[0].Table != "integration_test_truncate" {
+		t.Fatalf("unexpected snapshots %v", snapshots)
+	}
+
+	err = sink.Rollback(ctx, "test22", snapshots[0].ID)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	want := fmt.Sprintf("%s -> domain_area_raw.integration_test_truncate", ops.snapshots[0])
+	if len(ops.restores) != 1 || ops.restores[0] != want {
+		t.Errorf("unexpected restores, got %v", ops.restores)
+	}
+
+	if err := sink.Rollback(ctx, "test22", "integration_test_truncate"); err == nil {
+		t.Error("expected an invalid snapshot ID to be rejected")
+	}
+	if err := sink.Rollback(ctx, "test22", "integration_test_truncate_daily_snapshot_20211103_140509"); err == nil {
+		t.Error("expected a snapshot of another table to be rejected")
+	}
+	if len(ops.restores) != 1 {
+		t.Errorf("unexpected restores, got %v", ops.restores)
+	}
+}
+
+func Test_Start_WriteTruncate_WithLoadJobSnapshots(t *testing.T) {
+	ctx := context.Background()
+
+	s := schema(bigquery.WriteTruncate)
+	s.WriteMethod = sink.LoadJob
+	sourceStream := sink.Stream("test36", s,
+		sink.WithLoadJobSpool(t.TempDir()),
+		sink.WithSnapshots(sink.SnapshotOptions{}))
+
+	ops := &mockTableOperations{numRows: map[string]uint64{"domain_area_raw.integration_test_truncate": 100}}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithErrorChannel(make(chan error)))
+
+	for i := 0; i < 3; i++ {
+		sourceStream.Send(&row{s: fmt.Sprintf("%d", i), i: i, t: time.Now().UTC()})
+	}
+	sourceStream.Complete()
+
+	// The rows are loaded into the target table once it has been snapshotted.
+	ops.await(func() bool { return len(ops.loads) == 1 })
+
+	if len(ops.snapshots) != 1 || !strings.HasPrefix(ops.snapshots[0], "domain_area_raw.integration_test_truncate_snapshot_") {
+		t.Fatalf("expected a snapshot of the target table before the load, got %v", ops.snapshots)
+	}
+	if len(ops.loads) != 1 || ops.loads[0] != "domain_area_raw.integration_test_truncate WRITE_TRUNCATE" {
+		t.Errorf("unexpected loads, got %v", ops.loads)
+	}
+}
+
+func Test_Start_WriteTruncate_WithViewSwap(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream("test23", schema(bigquery.WriteTruncate), sink.WithViewSwap(sink.ViewSwapOptions{}))
+
+	ops := &mockTableOperations{}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithErrorChannel(make(chan error)))
+
+	view := "domain_area_raw.integration_test_truncate"
+	var versions []string
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 3; j++ {
+			sourceStream.Send(&row{s: fmt.Sprintf("%d", j), i: j, t: time.Now().UTC()})
+		}
+		sourceStream.Complete()
+
+		// The view is pointed at the version created by the iteration once the version is complete.
+		var version string
+		ops.await(func() bool {
+			version = ops.views[view]
+			return len(ops.tableCreations) > i && version == ops.tableCreations[i]
+		})
+
+		if !strings.HasPrefix(version, view+"_v") {
+			t.Fatalf("expected the view to select from a table version, got %q", version)
+		}
+		if len(ops.tableRows[version]) != 3 {
+			t.Errorf("unexpected number of rows in %s, got %d", version, len(ops.tableRows[version]))
+		}
+		versions = append(versions, version)
+	}
+
+	// The previous version expires once the view has been pointed at the new one.
+	ops.await(func() bool { return len(ops.expirations) == 1 })
+
+	if versions[0] == versions[1] {
+		t.Errorf("expected each iteration to write a new table version, got %s", versions[0])
+	}
+	if len(ops.expirations) != 1 || ops.expirations[0] != versions[0] {
+		t.Errorf("expected the previous version to expire, got %v", ops.expirations)
+	}
+	if len(ops.tableCopyOperations) != 0 {
+		t.Errorf("expected no copies, got %v", ops.tableCopyOperations)
+	}
+}
+
+func Test_Start_WriteTruncate_WithViewSwapRejected(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream("test38", schema(bigquery.WriteTruncate),
+		sink.WithViewSwap(sink.ViewSwapOptions{RejectedRetention: 24 * time.Hour}),
+		sink.WithTruncateGuard(sink.TruncateGuard{MinRows: 3}))
+
+	errChan := make(chan error, 1)
+	ops := &mockTableOperations{}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithErrorChannel(errChan))
+
+	sourceStream.Send(&row{s: "0", i: 0, t: time.Now().UTC()})
+	sourceStream.Complete()
+
+	var guardErr *sink.GuardError
+	if err := <-errChan; !errors.As(err, &guardErr) {
+		t.Fatalf("expected the iteration to be rejected, got %v", err)
+	}
+	if len(ops.views) != 0 {
+		t.Errorf("expected the view not to be created, got %v", ops.views)
+	}
+	if len(ops.tableCreations) == 0 || len(ops.expirations) != 1 || ops.expirations[0] != ops.tableCreations[0] {
+		t.Errorf("expected the rejected version to expire, got %v", ops.expirations)
+	}
+}
+
+func Test_Start_WriteTruncate_WithIteration(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream("test24", schema(bigquery.WriteTruncate))
+
+	ops := &mockTableOperations{}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithErrorChannel(make(chan error)))
+
+	aborted, err := sourceStream.(sink.IterativeStream).Begin(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := sourceStream.(sink.IterativeStream).Begin(ctx); err != sink.ErrIterationOpen {
+		t.Errorf("expected the open iteration to prevent another, got %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		_ = aborted.Send(&row{s: fmt.Sprintf("%d", i), i: i, t: time.Now().UTC()})
+	}
+	if err := aborted.Flush(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := aborted.Abort(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(ops.tableDeletions) != 1 || !strings.HasPrefix(ops.tableDeletions[0], "domain_area_raw.integration_test_truncate_") {
+		t.Errorf("expected the temporary table to be deleted, got %v", ops.tableDeletions)
+	}
+	if err := aborted.Send(&row{}); err != sink.ErrIterationClosed {
+		t.Errorf("expected sending on an aborted iteration to fail, got %v", err)
+	}
+
+	committed, err := sourceStream.(sink.IterativeStream).Begin(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if committed.ID() == aborted.ID() {
+		t.Errorf("expected a new iteration ID, got %s", committed.ID())
+	}
+	for i := 0; i < 2; i++ {
+		_ = committed.Send(&row{s: fmt.Sprintf("%d", i), i: i, t: time.Now().UTC()})
+	}
+	if err := committed.Commit(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := committed.Send(&row{}); err != sink.ErrIterationClosed {
+		t.Errorf("expected sending on a committed iteration to fail, got %v", err)
+	}
+	if err := committed.Commit(); err != sink.ErrIterationClosed {
+		t.Errorf("expected committing twice to fail, got %v", err)
+	}
+
+	if len(ops.tableCopyOperations) != 1 {
+		t.Fatalf("expected one copy to the target table, got %v", ops.tableCopyOperations)
+	}
+	if len(ops.rows) != 5 {
+		t.Errorf("unexpected number of rows written, got %d", len(ops.rows))
+	}
+	if ops.copiedRows[0] != 2 {
+		t.Errorf("expected only the rows of the committed iteration to be copied, got %d", ops.copiedRows[0])
+	}
+}
+
+func Test_Start_WriteTruncate_WithProducers(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream("test25", schema(bigquery.WriteTruncate))
+
+	ops := &mockTableOperations{}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithErrorChannel(make(chan error)))
+
+	it, err := sourceStream.(sink.IterativeStream).Begin(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for p := 0; p < 3; p++ {
+		if err := it.Join(); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		go func(p int) {
+			defer func() { _ = it.Done() }()
+			time.Sleep(time.Duration(p) * 10 * time.Millisecond)
+			for i := 0; i < 3; i++ {
+				_ = it.Send(&row{s: fmt.Sprintf("%d", p), i: i, t: time.Now().UTC()})
+			}
+		}(p)
+	}
+
+	if err := it.Commit(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(ops.tableCopyOperations) != 1 || ops.copiedRows[0] != 9 {
+		t.Errorf("expected the rows of every producer to be copied at once, got %v %v", ops.tableCopyOperations, ops.copiedRows)
+	}
+	if err := it.Done(); err != sink.ErrNoProducers {
+		t.Errorf("expected Done without producers to fail, got %v", err)
+	}
+}
+
+func Test_Start_WriteTruncate_WithProducerTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream("test26", schema(bigquery.WriteTruncate), sink.WithProducerTimeout(50*time.Millisecond))
+
+	ops := &mockTableOperations{}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithErrorChannel(make(chan error)))
+
+	it, err := sourceStream.(sink.IterativeStream).Begin(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	_ = it.Join()
+	_ = it.Join()
+	_ = it.Send(&row{s: "0", i: 0, t: time.Now().UTC()})
+	_ = it.Done()
+
+	err = it.Commit()
+	var timeoutErr *sink.ProducerTimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Pending != 1 {
+		t.Fatalf("expected the commit to time out with one pending producer, got %v", err)
+	}
+	if err := it.Send(&row{}); err != sink.ErrIterationClosed {
+		t.Errorf("expected the iteration to be aborted, got %v", err)
+	}
+	if len(ops.tableCopyOperations) != 0 {
+		t.Errorf("expected the target table to be left unchanged, got %v", ops.tableCopyOperations)
+	}
+	if _, err := sourceStream.(sink.IterativeStream).Begin(ctx); err != nil {
+		t.Errorf("expected a new iteration to begin after the timeout, got %v", err)
+	}
+}
+
+func Test_Start_WriteTruncate_WithLease(t *testing.T) {
+	ctx := context.Background()
+
+	locker := sink.FileLocker(t.TempDir())
+	lease := sink.LeaseOptions{Locker: locker, Holder: "replica-1", Wait: 50 * time.Millisecond, Interval: 10 * time.Millisecond}
+	name := "my-project.domain_area_raw.integration_test_truncate"
+
+	sourceStream := sink.Stream("test27", schema(bigquery.WriteTruncate))
+
+	errChan := make(chan error, 1)
+	ops := &mockTableOperations{}
+	fenced := &fencedOperations{mockTableOperations: ops}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(fenced),
+		sink.WithLease(lease),
+		sink.WithErrorChannel(errChan))
+
+	it, _ := sourceStream.(sink.IterativeStream).Begin(ctx)
+	_ = it.Send(&row{s: "0", i: 0, t: time.Now().UTC()})
+	if err := it.Commit(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(ops.tableCopyOperations) != 1 {
+		t.Fatalf("expected the target table to be replaced, got %v", ops.tableCopyOperations)
+	}
+	if len(fenced.tokens) != 1 || fenced.tokens[0] != 1 {
+		t.Errorf("expected the copy to carry the fencing token of the lease, got %v", fenced.tokens)
+	}
+	if _, err := locker.Acquire(ctx, name, "replica-2", time.Minute); err != nil {
+		t.Fatalf("expected the lease to be released, got %v", err)
+	}
+
+	it, _ = sourceStream.(sink.IterativeStream).Begin(ctx)
+	_ = it.Send(&row{s: "0", i: 0, t: time.Now().UTC()})
+	if err := it.Commit(); !errors.Is(err, sink.ErrLeaseHeld) {
+		t.Fatalf("expected the lease held by another replica to fail the commit, got %v", err)
+	}
+	if len(ops.tableCopyOperations) != 1 {
+		t.Errorf("expected the target table to be left unchanged, got %v", ops.tableCopyOperations)
+	}
+	<-errChan
+}
+
+// fencedOperations records the fencing tokens that copies are made under.
+type fencedOperations struct {
+	*mockTableOperations
+	tokens []int64
+}
+
+func (o *fencedOperations) CopyTable(ctx context.Context, source, dest *bigquery.Table) error {
+	if token, ok := sink.LeaseToken(ctx); ok {
+		o.tokens = append(o.tokens, token)
+	}
+	return o.mockTableOperations.CopyTable(ctx, source, dest)
+}
+
+// slowCopyOperations delays copies, which fail if their context is done first.
+type slowCopyOperations struct {
+	*mockTableOperations
+	delay time.Duration
+}
+
+func (o *slowCopyOperations) CopyTable(ctx context.Context, source, dest *bigquery.Table) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(o.delay):
+	}
+	return o.mockTableOperations.CopyTable(ctx, source, dest)
+}
+
+// stealingLocker behaves as if the lease were acquired anew by another holder once it has been acquired and renewed
+// the given number of times.
+type stealingLocker struct {
+	sink.Locker
+	after int
+	mux   sync.Mutex
+	calls int
+}
+
+func (l *stealingLocker) Acquire(ctx context.Context, name, holder string, ttl time.Duration) (*sink.Lease, error) {
+	lease, err := l.Locker.Acquire(ctx, name, holder, ttl)
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.calls++
+	if err != nil || l.calls <= l.after {
+		return lease, err
+	}
+	stolen := *lease
+	stolen.Token++
+	return &stolen, nil
+}
+
+func Test_Start_WriteTruncate_WithLeaseRenewal(t *testing.T) {
+	ctx := context.Background()
+
+	locker := sink.FileLocker(t.TempDir())
+	name := "my-project.domain_area_raw.integration_test_truncate"
+
+	sourceStream := sink.Stream("test39", schema(bigquery.WriteTruncate))
+
+	ops := &slowCopyOperations{mockTableOperations: &mockTableOperations{}, delay: 300 * time.Millisecond}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithLease(sink.LeaseOptions{Locker: locker, Holder: "replica-1", TTL: 90 * time.Millisecond}),
+		sink.WithErrorChannel(make(chan error, 1)))
+
+	// The copy outlasts the TTL, so the lease is only still held if it was renewed in the background.
+	held := make(chan error, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_, err := locker.Acquire(ctx, name, "replica-2", time.Minute)
+		held <- err
+	}()
+
+	it, _ := sourceStream.(sink.IterativeStream).Begin(ctx)
+	_ = it.Send(&row{s: "0", i: 0, t: time.Now().UTC()})
+	if err := it.Commit(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := <-held; err != sink.ErrLeaseHeld {
+		t.Errorf("expected the lease to be renewed during the copy, got %v", err)
+	}
+	if len(ops.tableCopyOperations) != 1 {
+		t.Errorf("expected the target table to be replaced, got %v", ops.tableCopyOperations)
+	}
+}
+
+func Test_Start_WriteTruncate_WithLeaseLost(t *testing.T) {
+	ctx := context.Background()
+
+	// The lease is lost after the renewal right before the copy, while the copy runs.
+	locker := &stealingLocker{Locker: sink.FileLocker(t.TempDir()), after: 2}
+
+	sourceStream := sink.Stream("test40", schema(bigquery.WriteTruncate))
+
+	ops := &slowCopyOperations{mockTableOperations: &mockTableOperations{}, delay: 10 * time.Second}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithLease(sink.LeaseOptions{Locker: locker, Holder: "replica-1", TTL: 90 * time.Millisecond}),
+		sink.WithErrorChannel(make(chan error, 1)))
+
+	it, _ := sourceStream.(sink.IterativeStream).Begin(ctx)
+	_ = it.Send(&row{s: "0", i: 0, t: time.Now().UTC()})
+	if err := it.Commit(); !errors.Is(err, sink.ErrLeaseLost) {
+		t.Fatalf("expected the lost lease to fail the commit, got %v", err)
+	}
+	if len(ops.tableCopyOperations) != 0 {
+		t.Errorf("expected the copy to be cancelled, got %v", ops.tableCopyOperations)
+	}
+}
+
+func Test_Start_WriteTruncate_WithValidation(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream("test28", schema(bigquery.WriteTruncate),
+		sink.WithValidation(sink.ValidationOptions{DeadLetterTable: "sink_dead_letters"}))
+
+	errChan := make(chan error, 2)
+	ops := &mockTableOperations{}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithErrorChannel(errChan))
+
+	it, _ := sourceStream.(sink.IterativeStream).Begin(ctx)
+	// The TIME column expects a civil.Time, so these rows are invalid.
+	_ = it.Send(&row{s: "0", i: 0, t: time.Now().UTC()})
+	_ = it.Send(&row{s: "1", i: 1, t: time.Now().UTC()})
+	_ = it.Send(loadedRow{"stringColumn": "2", "intColumn": 2, "timeColumn": civil.Time{Hour: 14}})
+	if err := it.Commit(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err := <-errChan
+		var validationErr *sink.ValidationError
+		if !errors.As(err, &validationErr) || len(validationErr.Errors) != 1 || validationErr.Errors[0].Field != "timeColumn" {
+			t.Errorf("expected the time column to be invalid, got %v", err)
+		}
+	}
+	if len(ops.tableRows["domain_area_raw.sink_dead_letters"]) != 2 {
+		t.Errorf("expected the invalid rows in the dead-letter table, got %d", len(ops.tableRows["domain_area_raw.sink_dead_letters"]))
+	}
+	if len(ops.copiedRows) != 1 || ops.copiedRows[0] != 1 {
+		t.Errorf("expected only the valid row to be copied, got %v", ops.copiedRows)
+	}
+}
+
+func Test_Start_WriteTruncate_WithCoercion(t *testing.T) {
+	ctx := context.Background()
+
+	sourceStream := sink.Stream("test29", schema(bigquery.WriteTruncate),
+		sink.WithCoercion(sink.CoercionOptions{}),
+		sink.WithValidation(sink.ValidationOptions{DeadLetterTable: "sink_dead_letters"}))
+
+	errChan := make(chan error, 2)
+	ops := &mockTableOperations{}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithErrorChannel(errChan))
+
+	it, _ := sourceStream.(sink.IterativeStream).Begin(ctx)
+	// The strings are coerced to the int64 and civil.Time values expected by the INTEGER and TIME columns. A time.Time
+	// would only be coerced in lenient mode, since the date would be lost.
+	_ = it.Send(loadedRow{"stringColumn": "0", "intColumn": 0, "timeColumn": "14:05:00"})
+	_ = it.Send(loadedRow{"stringColumn": "1", "intColumn": 1, "timeColumn": "14:05:00.5"})
+	_ = it.Send(loadedRow{"stringColumn": "2", "intColumn": "2", "timeColumn": "14:05:00"})
+	_ = it.Send(loadedRow{"stringColumn": "3", "intColumn": "three", "timeColumn": "14:05:00"})
+	if err := it.Commit(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	err := <-errChan
+	var coercionErr *sink.CoercionError
+	if !errors.As(err, &coercionErr) || len(coercionErr.Errors) != 1 || coercionErr.Errors[0].Field != "intColumn" {
+		t.Errorf("expected the int column not to be coerced, got %v", err)
+	}
+	if len(ops.tableRows["domain_area_raw.sink_dead_letters"]) != 1 {
+		t.Errorf("expected the row in the dead-letter table, got %d", len(ops.tableRows["domain_area_raw.sink_dead_letters"]))
+	}
+	if len(ops.copiedRows) != 1 || ops.copiedRows[0] != 3 {
+		t.Errorf("expected the coerced rows to be copied, got %v", ops.copiedRows)
+	}
+}
+
+func Test_Start_WriteTruncate_WithTransformers(t *testing.T) {
+	ctx := context.Background()
+
+	split := sink.Transformer{
+		Name: "split",
+		Transform: func(row map[string]bigquery.Value) ([]map[string]bigquery.Value, error) {
+			if row["intColumn"] == 99 {
+				return nil, errors.New("unexpected value")
+			}
+			if row["stringColumn"] != "split" {
+				return []map[string]bigquery.Value{row}, nil
+			}
+			return []map[string]bigquery.Value{
+				{"stringColumn": "split_0", "intColumn": row["intColumn"]},
+				{"stringColumn": "split_1", "intColumn": row["intColumn"]},
+			}, nil
+		},
+	}
+	sourceStream := sink.Stream("test30", schema(bigquery.WriteTruncate),
+		sink.WithTransformers(
+			sink.RenameColumn("name", "stringColumn"),
+			sink.FilterRows("non_negative", func(row map[string]bigquery.Value) bool { return row["intColumn"].(int) >= 0 }),
+			split),
+		sink.WithValidation(sink.ValidationOptions{}))
+
+	errChan := make(chan error, 2)
+	ops := &mockTableOperations{}
+
+	sink.Start(
+		ctx,
+		sink.WithBigQuery(projectID, datasetID),
+		sink.WithTableOperations(ops),
+		sink.WithErrorChannel(errChan))
+
+	it, _ := sourceStream.(sink.IterativeStream).Begin(ctx)
+	_ = it.Send(loadedRow{"name": "a", "intColumn": 1})
+	_ = it.Send(loadedRow{"name": "split", "intColumn": 2})
+	_ = it.Send(loadedRow{"name": "negative", "intColumn": -1})
+	_ = it.Send(loadedRow{"name": "rejected", "intColumn": 99})
+	if err := it.Commit(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	err := <-errChan
+	var transformerErr *sink.TransformerError
+	if !errors.As(err, &transformerErr) || transformerErr.Transformer != "split" {
+		t.Errorf("expected the row to be rejected by the split transformer, got %v", err)
+	}
+	select {
+	case err := <-errChan:
+		t.Errorf("expected the renamed rows to be valid, got %v", err)
+	default:
+	}
+	if len(ops.copiedRows) != 1 || ops.copiedRows[0] != 3 {
+		t.Errorf("expected the transformed rows to be copied, got %v", ops.copiedRows)
+	}
+}